@@ -0,0 +1,215 @@
+// Package audit keeps a record of every decision the mute service makes, both in
+// memory for the API and in a rotating JSON Lines file on disk.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/byuoitav/mute-service/state"
+	"go.uber.org/zap"
+)
+
+// Log is a state.DecisionRecorder that writes decisions to a rotating JSON Lines file
+// and keeps the most recent ones in memory
+type Log struct {
+	// Path is the file decisions are written to. Empty keeps decisions in memory only.
+	Path string
+	// MaxBytes is the size at which the file is rotated
+	MaxBytes int64
+	// MaxBackups is how many rotated files are kept, named Path.1 through Path.N
+	MaxBackups int
+	// Keep is how many decisions are kept in memory for each room
+	Keep int
+	// Log is where problems writing the file are reported. Defaults to discarding them.
+	Log *zap.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// reopen is set when the file couldn't be reopened after a rotation, so it is tried
+	// again with the next decision
+	reopen bool
+	recent map[string]*ring
+}
+
+// ring is the most recent decisions of a room
+type ring struct {
+	decisions []state.Decision
+	next      int
+}
+
+// Open opens the log's file for appending
+func (l *Log) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.open()
+}
+
+func (l *Log) open() error {
+	if l.Path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open decision log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to stat decision log: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// RecordDecision implements state.DecisionRecorder
+func (l *Log) RecordDecision(d state.Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remember(d)
+
+	if l.file == nil && l.reopen {
+		if err := l.open(); err != nil {
+			return
+		}
+
+		l.reopen = false
+		l.logger().Info("reopened decision log")
+	}
+
+	if l.file == nil {
+		return
+	}
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	if l.MaxBytes > 0 && l.size+int64(len(line)) > l.MaxBytes {
+		if err := l.rotate(); err != nil {
+			l.logger().Error("unable to rotate decision log", zap.Error(err))
+		}
+
+		if l.file == nil {
+			l.logger().Error("decision log closed, keeping decisions in memory until it can be reopened")
+			return
+		}
+	}
+
+	n, err := l.file.Write(line)
+	if err != nil {
+		l.logger().Error("unable to write to decision log", zap.Error(err))
+	}
+	l.size += int64(n)
+}
+
+func (l *Log) remember(d state.Decision) {
+	if l.Keep <= 0 {
+		return
+	}
+
+	if l.recent == nil {
+		l.recent = make(map[string]*ring)
+	}
+
+	r, ok := l.recent[d.Room]
+	if !ok {
+		r = &ring{}
+		l.recent[d.Room] = r
+	}
+
+	if len(r.decisions) < l.Keep {
+		r.decisions = append(r.decisions, d)
+		return
+	}
+
+	r.decisions[r.next] = d
+	r.next = (r.next + 1) % l.Keep
+}
+
+// rotate shifts Path.N-1 to Path.N, ..., Path to Path.1 and starts a new file. If Path
+// can't be moved aside, it is reopened so decisions keep being written to it.
+func (l *Log) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	for i := l.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+
+	var err error
+	if l.MaxBackups > 0 {
+		err = os.Rename(l.Path, l.Path+".1")
+	} else {
+		err = os.Remove(l.Path)
+	}
+
+	if openErr := l.open(); openErr != nil {
+		l.reopen = true
+		return openErr
+	}
+
+	return err
+}
+
+func (l *Log) logger() *zap.Logger {
+	if l.Log == nil {
+		return zap.NewNop()
+	}
+
+	return l.Log
+}
+
+// Recent returns up to n of the most recent decisions for room, oldest first.
+// An empty room returns decisions for every room.
+func (l *Log) Recent(room string, n int) []state.Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var decisions []state.Decision
+	for id, r := range l.recent {
+		if room != "" && id != room {
+			continue
+		}
+
+		for i := range r.decisions {
+			decisions = append(decisions, r.decisions[(r.next+i)%len(r.decisions)])
+		}
+	}
+
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Time.Before(decisions[j].Time)
+	})
+
+	if n > 0 && len(decisions) > n {
+		decisions = decisions[len(decisions)-n:]
+	}
+
+	return decisions
+}
+
+// Close closes the log's file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/mute-service/state"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecent(t *testing.T) {
+	log := &Log{Keep: 2}
+
+	start := time.Now()
+	for i, room := range []string{"ITB-1101", "ITB-1102", "ITB-1101", "ITB-1101", "ITB-1101"} {
+		log.RecordDecision(state.Decision{Room: room, Time: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	// each room keeps its own history, so the busy room doesn't push out the quiet one
+	assert.Equal(t, 2, len(log.Recent("ITB-1101", 0)))
+	assert.Equal(t, 1, len(log.Recent("ITB-1102", 0)))
+	assert.Equal(t, 1, len(log.Recent("ITB-1101", 1)))
+	assert.Equal(t, start.Add(4*time.Second), log.Recent("ITB-1101", 1)[0].Time)
+
+	all := log.Recent("", 0)
+	if assert.Equal(t, 3, len(all)) {
+		assert.Equal(t, "ITB-1102", all[0].Room, "decisions of every room are ordered by time")
+		assert.Equal(t, start.Add(4*time.Second), all[2].Time)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+	log := &Log{
+		Path:       path,
+		MaxBytes:   200,
+		MaxBackups: 2,
+	}
+
+	assert.Nil(t, log.Open())
+	for i := 0; i < 10; i++ {
+		log.RecordDecision(state.Decision{Room: "ITB-1101", Reason: "display input changed"})
+	}
+	assert.Nil(t, log.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		b, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(b), 200)
+		assert.True(t, strings.HasSuffix(string(b), "}\n"))
+	}
+
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	// a directory in the way of the first backup makes the rotation fail
+	assert.Nil(t, os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0755))
+
+	core, logs := observer.New(zap.ErrorLevel)
+	log := &Log{
+		Path:       path,
+		MaxBytes:   200,
+		MaxBackups: 1,
+		Log:        zap.New(core),
+	}
+
+	assert.Nil(t, log.Open())
+	for i := 0; i < 10; i++ {
+		log.RecordDecision(state.Decision{Room: "ITB-1101", Reason: "display input changed"})
+	}
+	assert.Nil(t, log.Close())
+
+	// every decision is still written, just without rotating
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, strings.Count(string(b), "\n"))
+	assert.NotZero(t, logs.FilterMessage("unable to rotate decision log").Len())
+}
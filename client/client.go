@@ -0,0 +1,143 @@
+// Package client builds http clients for the services the mute service talks to,
+// with optional TLS settings and credentials.
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options is how to connect to a service
+type Options struct {
+	// CAFile is a PEM bundle of certificate authorities to trust in addition to the system's
+	CAFile string `yaml:"caFile" json:"caFile"`
+	// CertFile and KeyFile are a PEM client certificate and key
+	CertFile string `yaml:"certFile" json:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`
+
+	// Username and Password are sent with basic auth
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// Token is sent as a bearer token, instead of basic auth
+	Token string `yaml:"token" json:"token"`
+}
+
+// Secrets is the credentials file, with Options for each service
+type Secrets struct {
+	DB    Options `yaml:"db" json:"db"`
+	AVAPI Options `yaml:"avApi" json:"avApi"`
+}
+
+// LoadSecrets reads a YAML or JSON Secrets file
+func LoadSecrets(path string) (Secrets, error) {
+	var secrets Secrets
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return secrets, fmt.Errorf("unable to read secrets: %w", err)
+	}
+
+	if err := yaml.Unmarshal(b, &secrets); err != nil {
+		return secrets, fmt.Errorf("unable to parse secrets: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// Or returns o with any empty fields filled in from fallback
+func (o Options) Or(fallback Options) Options {
+	or := func(a, b string) string {
+		if a != "" {
+			return a
+		}
+		return b
+	}
+
+	return Options{
+		CAFile:   or(o.CAFile, fallback.CAFile),
+		CertFile: or(o.CertFile, fallback.CertFile),
+		KeyFile:  or(o.KeyFile, fallback.KeyFile),
+		Username: or(o.Username, fallback.Username),
+		Password: or(o.Password, fallback.Password),
+		Token:    or(o.Token, fallback.Token),
+	}
+}
+
+// New builds an http.Client from opts
+func New(opts Options) (*http.Client, error) {
+	config := &tls.Config{}
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = config
+
+	return &http.Client{
+		Transport: &authTransport{
+			base:     base,
+			username: opts.Username,
+			password: opts.Password,
+			token:    opts.Token,
+		},
+	}, nil
+}
+
+// URL returns address as a URL, defaulting to http if it has no scheme
+func URL(address string) string {
+	if strings.Contains(address, "://") {
+		return strings.TrimSuffix(address, "/")
+	}
+
+	return "http://" + strings.TrimSuffix(address, "/")
+}
+
+type authTransport struct {
+	base     http.RoundTripper
+	username string
+	password string
+	token    string
+}
+
+func (t *authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	switch {
+	case t.token != "":
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+t.token)
+	case t.username != "":
+		r = r.Clone(r.Context())
+		r.SetBasicAuth(t.username, t.password)
+	}
+
+	return t.base.RoundTrip(r)
+}
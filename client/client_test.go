@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var auth string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	// without the server's CA the request fails
+	c, err := New(Options{})
+	assert.Nil(t, err)
+	_, err = c.Get(server.URL)
+	assert.NotNil(t, err)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	c, err = New(Options{CAFile: ca, Username: "couch", Password: "secret"})
+	assert.Nil(t, err)
+	_, err = c.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "Basic Y291Y2g6c2VjcmV0", auth)
+
+	c, err = New(Options{CAFile: ca, Token: "abc123"})
+	assert.Nil(t, err)
+	_, err = c.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer abc123", auth)
+
+	_, err = New(Options{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.NotNil(t, err)
+}
+
+func TestOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	os.WriteFile(path, []byte("db:\n  username: couch\n  password: file\navApi:\n  token: abc\n"), 0644)
+
+	secrets, err := LoadSecrets(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", secrets.AVAPI.Token)
+
+	opts := Options{Password: "flag"}.Or(secrets.DB)
+	assert.Equal(t, "couch", opts.Username)
+	assert.Equal(t, "flag", opts.Password)
+}
+
+func TestURL(t *testing.T) {
+	assert.Equal(t, "http://localhost:8000", URL("localhost:8000"))
+	assert.Equal(t, "https://couch.byu.edu:6984", URL("https://couch.byu.edu:6984/"))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/mute-service/client"
+	"github.com/byuoitav/mute-service/direct"
+	"github.com/byuoitav/mute-service/hub"
+	"github.com/byuoitav/mute-service/roomconfig"
+	"github.com/byuoitav/mute-service/state"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the settings of the service, each of which is a flag
+type settings struct {
+	configFile string
+	logLevel   string
+	deviceID   string
+	roomList   []string
+	building   string
+	hubAddress string
+	transport  string
+	mqttBroker string
+	mqttTopic  string
+	apiAddress string
+	dbAddress  string
+	roomFile   string
+	secrets    string
+	control    string
+	directFile string
+	policy     string
+	timeout    time.Duration
+	warmup     time.Duration
+	cooldown   time.Duration
+	port       int
+	auditLog   string
+	auditSize  int64
+	auditKeep  int
+	adopt      bool
+	failures   int
+	retryAfter time.Duration
+
+	dbFlags  *client.Options
+	apiFlags *client.Options
+}
+
+// newFlags registers a flag for every setting
+func newFlags(name string, errorHandling pflag.ErrorHandling) (*pflag.FlagSet, *settings) {
+	s := &settings{}
+	flags := pflag.NewFlagSet(name, errorHandling)
+
+	flags.StringVarP(&s.configFile, "config", "c", "", "YAML file of settings, keyed by flag name")
+	flags.StringVarP(&s.logLevel, "log-level", "L", "info", "Level at which the logger operates. Refer to https://godoc.org/go.uber.org/zap/zapcore#Level for options")
+	flags.StringVarP(&s.deviceID, "device-id", "", "", "Device id as found in couch")
+	flags.StringSliceVarP(&s.roomList, "rooms", "", nil, "Manage these rooms instead of the room of --device-id")
+	flags.StringVarP(&s.building, "building", "", "", "Manage every room in this building with auto mute enabled in its room configuration, instead of the room of --device-id")
+	flags.StringVarP(&s.hubAddress, "hub-address", "", "", "Address of the event hub")
+	flags.StringVarP(&s.transport, "event-transport", "", "hub", "Where room events come from: hub or mqtt")
+	flags.StringVarP(&s.mqttBroker, "mqtt-broker", "", "", "Address of the MQTT broker, e.g. tcp://broker:1883")
+	flags.StringVarP(&s.mqttTopic, "mqtt-topic", "", hub.DefaultMQTTTopic, "Topic room events are published on. {building} and {room} are replaced with the building and room id")
+	flags.StringVarP(&s.apiAddress, "av-api", "", "", "Address of the av-api")
+	flags.StringVarP(&s.control, "control", "", "av-api", "How displays are controlled: av-api, or direct to talk to them over their network control protocols")
+	flags.StringVarP(&s.directFile, "direct-config", "", "", "YAML or JSON file describing display models and room displays for --control direct")
+	flags.StringVarP(&s.dbAddress, "db-address", "", "", "Address of the room database")
+	flags.StringVarP(&s.secrets, "secrets", "", "", "YAML or JSON file of credentials for the room database (db) and av-api (avApi)")
+	s.dbFlags = clientFlags(flags, "db", "room database")
+	s.apiFlags = clientFlags(flags, "av-api", "av-api")
+	flags.DurationVarP(&s.timeout, "request-timeout", "", 10*time.Second, "How long to wait for a response from the room database or av-api")
+	flags.StringVarP(&s.roomFile, "room-config", "", "", "YAML or JSON file of room configuration to use instead of the room database")
+	flags.StringVarP(&s.policy, "policy", "", string(state.PolicySticky), "How the audio display is chosen for an input shown on several displays: sticky keeps the display that last had it, lowest-display-number always picks the lowest numbered display")
+	flags.DurationVarP(&s.warmup, "warmup", "", 10*time.Second, "How long to wait after a display powers on before resolving the room")
+	flags.DurationVarP(&s.cooldown, "cooldown", "", 2*time.Minute, "How long to wait after every display is in standby before forgetting the room's audio preferences")
+	flags.BoolVarP(&s.adopt, "adopt-unmuted", "", false, "Keep the audio on the displays that are already unmuted when the room is fetched instead of moving it to the lowest display number")
+	flags.IntVarP(&s.failures, "breaker-failures", "", 3, "Number of failed updates in a row after which updates are queued instead of sent until the backend recovers")
+	flags.DurationVarP(&s.retryAfter, "breaker-cooldown", "", 5*time.Second, "How long to wait before retrying failed updates, doubling while the backend keeps failing")
+	flags.IntVarP(&s.port, "port", "P", 8080, "Port the api server listens on")
+	flags.StringVarP(&s.auditLog, "audit-log", "", "", "Path of the JSON Lines decision log. Decisions are only kept in memory if empty")
+	flags.Int64VarP(&s.auditSize, "audit-log-size", "", 10, "Size in MB at which the decision log is rotated")
+	flags.IntVarP(&s.auditKeep, "audit-log-backups", "", 3, "Number of rotated decision logs to keep")
+
+	return flags, s
+}
+
+// envName returns the environment variable for a flag, e.g. MUTE_SERVICE_HUB_ADDRESS for hub-address
+func envName(flag string) string {
+	return "MUTE_SERVICE_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// loadSettings parses args, then sets each flag that wasn't given from its environment
+// variable, or else from the config file, leaving the rest at their defaults
+func loadSettings(flags *pflag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path, _ := flags.GetString("config")
+	if !flags.Changed("config") && os.Getenv(envName("config")) != "" {
+		path = os.Getenv(envName("config"))
+	}
+
+	file := make(map[string]string)
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return err
+		}
+	}
+
+	for name := range file {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in %s", name, path)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || err != nil {
+			return
+		}
+
+		value, source := os.Getenv(envName(f.Name)), envName(f.Name)
+		if value == "" {
+			value, source = file[f.Name], path
+		}
+
+		if value == "" {
+			return
+		}
+
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s from %s: %w", value, f.Name, source, setErr)
+		}
+	})
+
+	return err
+}
+
+// readConfigFile reads a YAML file of flag values, keyed by flag name. Lists are
+// joined with commas, like they are given on the command line.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse config file: %w", err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(v))
+			for i := range v {
+				items[i] = fmt.Sprint(v[i])
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("unable to parse config file: %s must be a single value or a list", name)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+// multiRoom returns true if the service manages a list of rooms instead of the room of its device
+func (s *settings) multiRoom() bool {
+	return len(s.roomList) > 0 || s.building != ""
+}
+
+// validate returns an error describing the first invalid or missing setting
+func (s *settings) validate() error {
+	var level zapcore.Level
+
+	switch {
+	case level.Set(s.logLevel) != nil:
+		return errors.New("Invalid log level. Use --log-level to choose debug, info, warn or error")
+	case s.deviceID == "" && !s.multiRoom():
+		return errors.New("Device ID required. Use --device-id to provide the id of the device, or --rooms or --building to manage several rooms")
+	case s.transport != "hub" && s.transport != "mqtt":
+		return errors.New("Invalid event transport. Use --event-transport to choose hub or mqtt")
+	case s.transport == "hub" && s.hubAddress == "":
+		return errors.New("Event hub address required. Use --hub-address to provide the address of the event hub")
+	case s.transport == "mqtt" && s.mqttBroker == "":
+		return errors.New("MQTT broker address required. Use --mqtt-broker to provide the address of the MQTT broker")
+	case s.control != "av-api" && s.control != "direct":
+		return errors.New("Invalid control backend. Use --control to choose av-api or direct")
+	case s.control == "av-api" && s.apiAddress == "":
+		return errors.New("AV API address required. Use --av-api to provide the address of the av-api")
+	case s.control == "direct" && s.directFile == "":
+		return errors.New("Direct control config required. Use --direct-config to provide the display command tables")
+	case !state.Policy(s.policy).Valid():
+		return errors.New("Invalid policy. Use --policy to choose sticky or lowest-display-number")
+	}
+
+	return nil
+}
+
+// validateConfig checks the settings given the same way as when running the service,
+// including that the files they refer to can be loaded, and prints the resulting settings
+func validateConfig(args []string) error {
+	flags, s := newFlags("validate-config", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate-config [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := loadSettings(flags, args); err != nil {
+		return err
+	}
+
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	if _, _, err := buildClients(s.dbFlags, s.apiFlags, s.secrets); err != nil {
+		return fmt.Errorf("invalid secrets file: %w", err)
+	}
+
+	if s.control == "direct" {
+		if _, err := direct.Load(s.directFile); err != nil {
+			return fmt.Errorf("invalid direct control config: %w", err)
+		}
+	}
+
+	if s.roomFile != "" {
+		if _, err := (&roomconfig.File{Path: s.roomFile}).Rooms(""); err != nil {
+			return fmt.Errorf("invalid room config: %w", err)
+		}
+	}
+
+	fmt.Printf("configuration is valid:\n%s\n", describeSettings(flags))
+	return nil
+}
+
+// describeSettings lists every setting as "name: value", sorted by name, with passwords
+// and tokens masked
+func describeSettings(flags *pflag.FlagSet) string {
+	var lines []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		value := f.Value.String()
+		if value != "" && (strings.HasSuffix(f.Name, "-password") || strings.HasSuffix(f.Name, "-token")) {
+			value = "********"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %s", f.Name, value))
+	})
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfig writes a config file to a temporary directory and returns its path
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "mute-service.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		file string
+		want string
+	}{
+		{name: "default", want: ""},
+		{name: "file", file: "hub-address: file:7100\n", want: "file:7100"},
+		{name: "env over file", env: "env:7100", file: "hub-address: file:7100\n", want: "env:7100"},
+		{name: "flag over env", args: []string{"--hub-address", "flag:7100"}, env: "env:7100", file: "hub-address: file:7100\n", want: "flag:7100"},
+		{name: "empty env ignored", env: "", file: "hub-address: file:7100\n", want: "file:7100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MUTE_SERVICE_HUB_ADDRESS", tt.env)
+
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "--config", writeConfig(t, tt.file))
+			}
+
+			flags, s := newFlags("test", pflag.ContinueOnError)
+			assert.Nil(t, loadSettings(flags, args))
+			assert.Equal(t, tt.want, s.hubAddress)
+		})
+	}
+}
+
+func TestLoadSettingsFile(t *testing.T) {
+	path := writeConfig(t, `
+rooms:
+  - ITB-1101
+  - ITB-1108A
+warmup: 5s
+adopt-unmuted: true
+port: 9000
+db-password:
+`)
+
+	// the config file can come from the environment too
+	t.Setenv("MUTE_SERVICE_CONFIG", path)
+	t.Setenv("MUTE_SERVICE_PORT", "9100")
+
+	flags, s := newFlags("test", pflag.ContinueOnError)
+	assert.Nil(t, loadSettings(flags, []string{"--warmup", "1s"}))
+
+	assert.Equal(t, []string{"ITB-1101", "ITB-1108A"}, s.roomList)
+	assert.Equal(t, time.Second, s.warmup)
+	assert.Equal(t, true, s.adopt)
+	assert.Equal(t, 9100, s.port)
+	assert.Equal(t, "", s.dbFlags.Password)
+	assert.Equal(t, 2*time.Minute, s.cooldown)
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		err  string
+	}{
+		{name: "unknown key", file: "hub-adress: hub:7100\n", err: `unknown setting "hub-adress"`},
+		{name: "nested value", file: "av-api:\n  address: api:8000\n", err: "av-api must be a single value or a list"},
+		{name: "invalid yaml", file: "rooms: [ITB-1101\n", err: "unable to parse config file"},
+		{name: "invalid file value", file: "port: eighty\n", err: `invalid value "eighty" for port from`},
+		{name: "invalid env value", env: map[string]string{"MUTE_SERVICE_WARMUP": "soon"}, err: `invalid value "soon" for warmup from MUTE_SERVICE_WARMUP`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			var args []string
+			if tt.file != "" {
+				args = []string{"--config", writeConfig(t, tt.file)}
+			}
+
+			flags, _ := newFlags("test", pflag.ContinueOnError)
+			err := loadSettings(flags, args)
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+
+	flags, _ := newFlags("test", pflag.ContinueOnError)
+	assert.NotNil(t, loadSettings(flags, []string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}))
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *settings {
+		_, s := newFlags("test", pflag.ContinueOnError)
+		s.deviceID = "ITB-1101-CP1"
+		s.hubAddress = "ws://hub:7100"
+		s.apiAddress = "http://localhost:8000"
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *settings)
+		err    string
+	}{
+		{name: "valid", change: func(s *settings) {}},
+		{name: "log level", change: func(s *settings) { s.logLevel = "loud" }, err: "Invalid log level"},
+		{name: "device id", change: func(s *settings) { s.deviceID = "" }, err: "Device ID required"},
+		{name: "rooms instead of device id", change: func(s *settings) { s.deviceID, s.roomList = "", []string{"ITB-1101"} }},
+		{name: "transport", change: func(s *settings) { s.transport = "carrier-pigeon" }, err: "Invalid event transport"},
+		{name: "mqtt broker", change: func(s *settings) { s.transport = "mqtt" }, err: "MQTT broker address required"},
+		{name: "direct config", change: func(s *settings) { s.control = "direct" }, err: "Direct control config required"},
+		{name: "policy", change: func(s *settings) { s.policy = "random" }, err: "Invalid policy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid()
+			tt.change(s)
+
+			err := s.validate()
+			if tt.err == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	path := writeConfig(t, `
+device-id: ITB-1101-CP1
+hub-address: ws://hub:7100
+av-api: http://localhost:8000
+`)
+
+	assert.Nil(t, validateConfig([]string{"--config", path}))
+	assert.NotNil(t, validateConfig([]string{"--config", path, "--log-level", "loud"}))
+	assert.NotNil(t, validateConfig([]string{"--config", path, "--room-config", filepath.Join(t.TempDir(), "missing.yaml")}))
+}
+
+func TestDescribeSettings(t *testing.T) {
+	flags, _ := newFlags("test", pflag.ContinueOnError)
+	assert.Nil(t, loadSettings(flags, []string{"--db-password", "hunter2", "--av-api-token", "abc123", "--db-username", "mute"}))
+
+	description := describeSettings(flags)
+	assert.NotContains(t, description, "hunter2")
+	assert.NotContains(t, description, "abc123")
+
+	lines := strings.Split(description, "\n")
+	assert.Contains(t, lines, "db-password: ********")
+	assert.Contains(t, lines, "av-api-token: ********")
+	assert.Contains(t, lines, "db-username: mute")
+	assert.Contains(t, lines, "av-api-password: ", "empty secrets aren't masked")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/byuoitav/mute-service/client"
+	"github.com/spf13/pflag"
+)
+
+// clientFlags registers flags for connecting to service, e.g. --db-username for db
+func clientFlags(flags *pflag.FlagSet, service, description string) *client.Options {
+	opts := &client.Options{}
+	flags.StringVarP(&opts.CAFile, service+"-ca-file", "", "", "PEM bundle of extra certificate authorities to trust for the "+description)
+	flags.StringVarP(&opts.CertFile, service+"-cert-file", "", "", "PEM client certificate for the "+description)
+	flags.StringVarP(&opts.KeyFile, service+"-key-file", "", "", "PEM client key for the "+description)
+	flags.StringVarP(&opts.Username, service+"-username", "", "", "Username for the "+description)
+	flags.StringVarP(&opts.Password, service+"-password", "", "", "Password for the "+description)
+	flags.StringVarP(&opts.Token, service+"-token", "", "", "Bearer token for the "+description)
+	return opts
+}
+
+// buildClients builds the database and av-api client options from flags, which
+// already include the environment and config file, then the secrets file
+func buildClients(dbFlags, apiFlags *client.Options, secretsFile string) (db, api client.Options, err error) {
+	var secrets client.Secrets
+	if secretsFile != "" {
+		if secrets, err = client.LoadSecrets(secretsFile); err != nil {
+			return db, api, err
+		}
+	}
+
+	db = dbFlags.Or(secrets.DB)
+	api = apiFlags.Or(secrets.AVAPI)
+	return db, api, nil
+}
@@ -0,0 +1,240 @@
+// Package direct controls displays directly over their network control protocols,
+// for when the av-api isn't available.
+package direct
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/mute-service/state"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes the display models the backend knows how to talk to and the
+// displays in each room
+type Config struct {
+	Models map[string]Model     `yaml:"models" json:"models"`
+	Rooms  map[string][]Display `yaml:"rooms" json:"rooms"`
+}
+
+// Display is a display in a room
+type Display struct {
+	// Name is the display's name in the room, e.g. D1
+	Name    string `yaml:"name" json:"name"`
+	Address string `yaml:"address" json:"address"`
+	Model   string `yaml:"model" json:"model"`
+}
+
+// Model is the command table for a line based TCP control protocol
+type Model struct {
+	Port int `yaml:"port" json:"port"`
+	// Delimiter ends every command and response. Defaults to a carriage return.
+	Delimiter string `yaml:"delimiter" json:"delimiter"`
+	// Timeout bounds each command, including connecting. Defaults to 3 seconds.
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+
+	Mute   string `yaml:"mute" json:"mute"`
+	Unmute string `yaml:"unmute" json:"unmute"`
+
+	Power Query `yaml:"power" json:"power"`
+	Input Query `yaml:"input" json:"input"`
+	Muted Query `yaml:"muted" json:"muted"`
+}
+
+// Query is a command that asks a display for a value
+type Query struct {
+	Command string `yaml:"command" json:"command"`
+	// Response is a regular expression whose first group is the value in the response
+	Response string `yaml:"response" json:"response"`
+	// Values maps the display's values to the av-api's, e.g. "1" to "on". Values not in the map are used as is.
+	Values map[string]string `yaml:"values" json:"values"`
+}
+
+// Load reads a YAML or JSON Config from path
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read direct control config: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse direct control config: %w", err)
+	}
+
+	for room, displays := range config.Rooms {
+		for _, d := range displays {
+			if _, ok := config.Models[d.Model]; !ok {
+				return nil, fmt.Errorf("display %s in %s has unknown model %q", d.Name, room, d.Model)
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+// Backend is a state.Backend that talks directly to displays
+type Backend struct {
+	Config *Config
+	Log    *zap.Logger
+}
+
+var _ state.Backend = &Backend{}
+
+// RoomState implements state.Backend. Displays that can't be reached are left out.
+func (b *Backend) RoomState(roomID string) (*state.AVState, error) {
+	displays, ok := b.Config.Rooms[roomID]
+	if !ok {
+		return nil, fmt.Errorf("no displays configured for %s", roomID)
+	}
+
+	avState := &state.AVState{}
+	for _, d := range displays {
+		ad, err := b.display(d)
+		if err != nil {
+			b.Log.Warn("failed to get display state", zap.String("display", d.Name), zap.Error(err))
+			continue
+		}
+
+		avState.Displays = append(avState.Displays, state.Display{Name: d.Name})
+		avState.AudioDevices = append(avState.AudioDevices, ad)
+	}
+
+	if len(avState.AudioDevices) == 0 {
+		return nil, fmt.Errorf("unable to reach any display in %s", roomID)
+	}
+
+	return avState, nil
+}
+
+func (b *Backend) display(d Display) (state.AudioDevice, error) {
+	model := b.Config.Models[d.Model]
+	ad := state.AudioDevice{
+		AudioBase: state.AudioBase{
+			Name: d.Name,
+		},
+	}
+
+	var err error
+	if ad.Power, err = query(d.Address, model, model.Power); err != nil {
+		return ad, fmt.Errorf("unable to get power: %w", err)
+	}
+
+	// displays in standby often don't answer anything but power queries
+	if ad.Power == "standby" {
+		return ad, nil
+	}
+
+	if ad.Input, err = query(d.Address, model, model.Input); err != nil {
+		return ad, fmt.Errorf("unable to get input: %w", err)
+	}
+
+	muted, err := query(d.Address, model, model.Muted)
+	if err != nil {
+		return ad, fmt.Errorf("unable to get muted: %w", err)
+	}
+
+	if ad.Muted, err = strconv.ParseBool(muted); err != nil {
+		return ad, fmt.Errorf("muted value %q is not a boolean", muted)
+	}
+
+	return ad, nil
+}
+
+// UpdateRoomState implements state.Backend
+func (b *Backend) UpdateRoomState(roomID string, avState *state.AVState) error {
+	var failed []string
+	for _, ad := range avState.AudioDevices {
+		d, ok := b.find(roomID, ad.Name)
+		if !ok {
+			continue
+		}
+
+		model := b.Config.Models[d.Model]
+		command := model.Unmute
+		if ad.Muted {
+			command = model.Mute
+		}
+
+		if _, err := send(d.Address, model, command); err != nil {
+			b.Log.Warn("failed to set display mute", zap.String("display", d.Name), zap.Bool("muted", ad.Muted), zap.Error(err))
+			failed = append(failed, d.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to set mute on %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (b *Backend) find(roomID, name string) (Display, bool) {
+	for _, d := range b.Config.Rooms[roomID] {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Display{}, false
+}
+
+func query(address string, model Model, q Query) (string, error) {
+	resp, err := send(address, model, q.Command)
+	if err != nil {
+		return "", err
+	}
+
+	re, err := regexp.Compile(q.Response)
+	if err != nil {
+		return "", fmt.Errorf("invalid response pattern: %w", err)
+	}
+
+	match := re.FindStringSubmatch(resp)
+	if len(match) < 2 {
+		return "", fmt.Errorf("unexpected response %q", resp)
+	}
+
+	if v, ok := q.Values[match[1]]; ok {
+		return v, nil
+	}
+	return match[1], nil
+}
+
+// send sends a single command and returns the first line of the response
+func send(address string, model Model, command string) (string, error) {
+	delimiter := model.Delimiter
+	if delimiter == "" {
+		delimiter = "\r"
+	}
+
+	timeout := model.Timeout
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(model.Port)), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte(command + delimiter)); err != nil {
+		return "", err
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString(delimiter[len(delimiter)-1])
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(resp), nil
+}
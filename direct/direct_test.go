@@ -0,0 +1,195 @@
+package direct
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/byuoitav/mute-service/state"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeDisplay speaks a tiny line based protocol: POWR?, INPT?, MUTE? and MUTE 0/1
+type fakeDisplay struct {
+	net.Listener
+
+	mu    sync.Mutex
+	muted bool
+	power string
+}
+
+func newFakeDisplay(t *testing.T, power string) *fakeDisplay {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDisplay{Listener: l, power: power}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+func (d *fakeDisplay) serve(conn net.Conn) {
+	defer conn.Close()
+
+	command, err := bufio.NewReader(conn).ReadString('\r')
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch strings.TrimSpace(command) {
+	case "POWR?":
+		conn.Write([]byte("POWR" + d.power + "\r"))
+	case "INPT?":
+		conn.Write([]byte("INPT HDMI1\r"))
+	case "MUTE?":
+		if d.muted {
+			conn.Write([]byte("MUTE1\r"))
+		} else {
+			conn.Write([]byte("MUTE0\r"))
+		}
+	case "MUTE 1":
+		d.muted = true
+		conn.Write([]byte("OK\r"))
+	case "MUTE 0":
+		d.muted = false
+		conn.Write([]byte("OK\r"))
+	}
+}
+
+func (d *fakeDisplay) port() int {
+	return d.Addr().(*net.TCPAddr).Port
+}
+
+const testConfig = `
+models:
+  generic:
+    port: 4660
+    mute: MUTE 1
+    unmute: MUTE 0
+    power:
+      command: POWR?
+      response: POWR(\d)
+      values:
+        "1": "on"
+        "0": standby
+    input:
+      command: INPT?
+      response: INPT (\w+)
+    muted:
+      command: MUTE?
+      response: MUTE(\d)
+      values:
+        "1": "true"
+        "0": "false"
+rooms:
+  ITB-1101:
+    - name: D1
+      address: 127.0.0.1
+      model: generic
+    - name: D2
+      address: 127.0.0.1
+      model: missing
+`
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "direct.yaml")
+	os.WriteFile(path, []byte(testConfig), 0644)
+
+	_, err := Load(path)
+	assert.NotNil(t, err, "unknown models should be rejected")
+
+	os.WriteFile(path, []byte(strings.Replace(testConfig, "missing", "generic", 1)), 0644)
+	config, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Rooms["ITB-1101"]))
+	assert.Equal(t, "on", config.Models["generic"].Power.Values["1"])
+}
+
+func TestBackend(t *testing.T) {
+	on := newFakeDisplay(t, "1")
+	defer on.Close()
+
+	off := newFakeDisplay(t, "0")
+	defer off.Close()
+
+	model := func(port int) Model {
+		return Model{
+			Port:   port,
+			Mute:   "MUTE 1",
+			Unmute: "MUTE 0",
+			Power:  Query{Command: "POWR?", Response: `POWR(\d)`, Values: map[string]string{"1": "on", "0": "standby"}},
+			Input:  Query{Command: "INPT?", Response: `INPT (\w+)`},
+			Muted:  Query{Command: "MUTE?", Response: `MUTE(\d)`, Values: map[string]string{"1": "true", "0": "false"}},
+		}
+	}
+
+	backend := &Backend{
+		Log: zap.NewExample(),
+		Config: &Config{
+			Models: map[string]Model{
+				"on":  model(on.port()),
+				"off": model(off.port()),
+				// nothing listens on the port of the listener that was closed
+				"gone": model(func() int {
+					l, _ := net.Listen("tcp", "127.0.0.1:0")
+					defer l.Close()
+					return l.Addr().(*net.TCPAddr).Port
+				}()),
+			},
+			Rooms: map[string][]Display{
+				"ITB-1101": {
+					{Name: "D1", Address: "127.0.0.1", Model: "on"},
+					{Name: "D2", Address: "127.0.0.1", Model: "off"},
+					{Name: "D3", Address: "127.0.0.1", Model: "gone"},
+				},
+			},
+		},
+	}
+
+	avState, err := backend.RoomState("ITB-1101")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(avState.AudioDevices))
+	assert.Equal(t, "on", avState.AudioDevices[0].Power)
+	assert.Equal(t, "HDMI1", avState.AudioDevices[0].Input)
+	assert.Equal(t, false, avState.AudioDevices[0].Muted)
+	assert.Equal(t, "standby", avState.AudioDevices[1].Power)
+
+	err = backend.UpdateRoomState("ITB-1101", &state.AVState{
+		AudioDevices: []state.AudioDevice{
+			{AudioBase: state.AudioBase{Name: "D1", Muted: true}},
+		},
+	})
+	assert.Nil(t, err)
+
+	avState, _ = backend.RoomState("ITB-1101")
+	assert.Equal(t, true, avState.AudioDevices[0].Muted)
+
+	err = backend.UpdateRoomState("ITB-1101", &state.AVState{
+		AudioDevices: []state.AudioDevice{
+			{AudioBase: state.AudioBase{Name: "D3", Muted: true}},
+		},
+	})
+	assert.NotNil(t, err)
+
+	_, err = backend.RoomState("ITB-1102")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,254 @@
+// Package hub abstracts where the mute service receives room events from and sends them to.
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/common/v2/events"
+	"github.com/gorilla/websocket"
+)
+
+// EventSource delivers events for the rooms it is subscribed to
+type EventSource interface {
+	SubscribeToRooms(rooms ...string)
+	// ReceiveEvent blocks until the next event is available
+	ReceiveEvent() events.Event
+}
+
+// EventSink accepts events to publish
+type EventSink interface {
+	SendEvent(event events.Event)
+}
+
+// Connection is implemented by event sources that can lose their connection
+type Connection interface {
+	// Connected returns true if the source is currently connected
+	Connected() bool
+	// ConnectionChanges delivers false each time the source disconnects and true each time it
+	// reconnects, starting after it first connects
+	ConnectionChanges() <-chan bool
+}
+
+// Messenger is an EventSource and EventSink backed by a central-event-system hub. It
+// speaks the hub's websocket protocol itself rather than wrapping the upstream
+// messenger, which reconnects without telling its caller and only exposes its connection
+// state through GetState, whose fields its pumps write without a lock.
+type Messenger struct {
+	address string
+	retry   time.Duration
+	events  chan events.Event
+	send    chan base.EventWrapper
+	changes chan bool
+
+	mu            sync.Mutex
+	rooms         map[string]bool
+	conn          *websocket.Conn
+	everConnected bool
+
+	// writeMu serializes writes to conn, which doesn't allow concurrent writers
+	writeMu sync.Mutex
+}
+
+var (
+	_ EventSource = &Messenger{}
+	_ EventSink   = &Messenger{}
+	_ Connection  = &Messenger{}
+	_ EventSource = &Memory{}
+	_ EventSink   = &Memory{}
+	_ Connection  = &Memory{}
+	_ EventSource = &MQTT{}
+	_ EventSink   = &MQTT{}
+	_ Connection  = &MQTT{}
+)
+
+// NewMessenger connects to the hub at address. If the hub can't be reached, the
+// messenger keeps retrying in the background until it connects.
+func NewMessenger(address string) (*Messenger, error) {
+	return newMessenger(address, 3*time.Second)
+}
+
+func newMessenger(address string, retry time.Duration) (*Messenger, error) {
+	if address == "" {
+		return nil, errors.New("hub address required")
+	}
+
+	h := &Messenger{
+		address: address,
+		retry:   retry,
+		events:  make(chan events.Event, 5000),
+		send:    make(chan base.EventWrapper, 5000),
+		changes: make(chan bool, 10),
+		rooms:   make(map[string]bool),
+	}
+
+	go h.run()
+	return h, nil
+}
+
+// SubscribeToRooms implements EventSource
+func (h *Messenger) SubscribeToRooms(rooms ...string) {
+	if len(rooms) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, room := range rooms {
+		h.rooms[room] = true
+	}
+
+	if h.conn != nil {
+		h.subscribe(h.conn, rooms)
+	}
+}
+
+// ReceiveEvent implements EventSource
+func (h *Messenger) ReceiveEvent() events.Event {
+	return <-h.events
+}
+
+// SendEvent implements EventSink. Events sent while the hub is down are sent once it
+// reconnects.
+func (h *Messenger) SendEvent(event events.Event) {
+	h.send <- base.WrapEvent(event)
+}
+
+// Connected implements Connection
+func (h *Messenger) Connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.conn != nil
+}
+
+// ConnectionChanges implements Connection
+func (h *Messenger) ConnectionChanges() <-chan bool {
+	return h.changes
+}
+
+// run connects to the hub and reads from it until the connection drops, then reconnects
+func (h *Messenger) run() {
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+	for {
+		conn, _, err := dialer.Dial(fmt.Sprintf("%s/connect/%s", h.address, base.Messenger), nil)
+		if err != nil {
+			time.Sleep(h.retry)
+			continue
+		}
+
+		h.connected(conn)
+
+		done := make(chan struct{})
+		go h.write(conn, done)
+		h.read(conn)
+		close(done)
+
+		h.disconnected(conn)
+		time.Sleep(h.retry)
+	}
+}
+
+// connected subscribes to every room again, since subscriptions don't survive a reconnect
+func (h *Messenger) connected(conn *websocket.Conn) {
+	h.mu.Lock()
+	reconnect := h.everConnected
+	h.conn = conn
+	h.everConnected = true
+
+	rooms := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	if len(rooms) > 0 {
+		h.subscribe(conn, rooms)
+	}
+	h.mu.Unlock()
+
+	if reconnect {
+		h.changes <- true
+	}
+}
+
+func (h *Messenger) disconnected(conn *websocket.Conn) {
+	conn.Close()
+
+	h.mu.Lock()
+	h.conn = nil
+	h.mu.Unlock()
+
+	h.changes <- false
+}
+
+func (h *Messenger) subscribe(conn *websocket.Conn, rooms []string) {
+	b, err := json.Marshal(base.SubscriptionChange{Rooms: rooms, Create: true})
+	if err != nil {
+		return
+	}
+
+	h.writeMessage(conn, websocket.TextMessage, b)
+}
+
+// read delivers events from conn until it fails. The hub pings regularly, so a connection
+// that goes quiet for longer than hubconn.PingWait is treated as dropped.
+func (h *Messenger) read(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(hubconn.PingWait))
+	conn.SetPingHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(hubconn.PingWait))
+		return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(hubconn.WriteWait))
+	})
+
+	for {
+		t, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if t != websocket.BinaryMessage {
+			continue
+		}
+
+		msg, nerr := base.ParseMessage(b)
+		if nerr != nil {
+			continue
+		}
+
+		var event events.Event
+		if err := json.Unmarshal(msg.Event, &event); err != nil {
+			continue
+		}
+
+		h.events <- event
+	}
+}
+
+// write sends queued events on conn until done is closed or a write fails, which closes
+// conn so read returns too
+func (h *Messenger) write(conn *websocket.Conn, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case msg := <-h.send:
+			if err := h.writeMessage(conn, websocket.BinaryMessage, base.PrepareMessage(msg)); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (h *Messenger) writeMessage(conn *websocket.Conn, t int, b []byte) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(hubconn.WriteWait))
+	return conn.WriteMessage(t, b)
+}
@@ -0,0 +1,205 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/byuoitav/common/v2/events"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHub accepts messenger connections, handing each to the test
+type fakeHub struct {
+	*httptest.Server
+	conns chan *websocket.Conn
+}
+
+func newFakeHub() *fakeHub {
+	h := &fakeHub{conns: make(chan *websocket.Conn, 10)}
+	upgrader := websocket.Upgrader{}
+
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/connect/"+base.Messenger {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		h.conns <- conn
+	}))
+
+	return h
+}
+
+func (h *fakeHub) address() string {
+	return "ws" + strings.TrimPrefix(h.URL, "http")
+}
+
+func (h *fakeHub) accept(t *testing.T) *websocket.Conn {
+	select {
+	case conn := <-h.conns:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("messenger didn't connect")
+		return nil
+	}
+}
+
+func readSubscription(t *testing.T, conn *websocket.Conn) base.SubscriptionChange {
+	var change base.SubscriptionChange
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(b, &change))
+	return change
+}
+
+func nextChange(t *testing.T, m *Messenger) bool {
+	select {
+	case connected := <-m.ConnectionChanges():
+		return connected
+	case <-time.After(time.Second):
+		t.Fatal("no connection change")
+		return false
+	}
+}
+
+func TestMessenger(t *testing.T) {
+	server := newFakeHub()
+	defer server.Close()
+
+	m, err := newMessenger(server.address(), 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	conn := server.accept(t)
+	assert.Eventually(t, m.Connected, time.Second, 10*time.Millisecond)
+
+	m.SubscribeToRooms("ITB-1101")
+	assert.Equal(t, []string{"ITB-1101"}, readSubscription(t, conn).Rooms)
+
+	// events from the hub are received
+	event := events.Event{Key: "power", AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1101"}}
+	assert.Nil(t, conn.WriteMessage(websocket.BinaryMessage, base.PrepareMessage(base.WrapEvent(event))))
+	assert.Equal(t, "power", m.ReceiveEvent().Key)
+
+	// events sent are written to the hub
+	m.SendEvent(events.Event{Key: "muted", AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1101"}})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	msg, nerr := base.ParseMessage(b)
+	assert.Nil(t, nerr)
+	assert.Equal(t, "ITB-1101", msg.Room)
+}
+
+func TestMessengerConnectionChanges(t *testing.T) {
+	server := newFakeHub()
+	defer server.Close()
+
+	m, err := newMessenger(server.address(), 10*time.Millisecond)
+	assert.Nil(t, err)
+	m.SubscribeToRooms("ITB-1101", "ITB-1102")
+
+	conn := server.accept(t)
+	assert.ElementsMatch(t, []string{"ITB-1101", "ITB-1102"}, readSubscription(t, conn).Rooms)
+	assert.Eventually(t, m.Connected, time.Second, 10*time.Millisecond)
+
+	// subscribing while the connection drops and comes back must be safe
+	go m.SubscribeToRooms("ITB-1103")
+
+	conn.Close()
+	assert.Equal(t, false, nextChange(t, m))
+
+	conn = server.accept(t)
+	assert.Equal(t, true, nextChange(t, m))
+	assert.Equal(t, true, m.Connected())
+
+	// every room is subscribed to again after reconnecting
+	rooms := readSubscription(t, conn).Rooms
+	assert.Subset(t, rooms, []string{"ITB-1101", "ITB-1102"})
+}
+
+// newRouter serves messenger connections with the hub's own router
+func newRouter() *httptest.Server {
+	if nexus.N == nil {
+		nexus.StartNexus()
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hubconn.CreateConnection(w, r, base.Messenger, nexus.N)
+	}))
+}
+
+// routed sends event from one messenger until the other receives it, since the router
+// registers subscriptions asynchronously
+func routed(t *testing.T, from, to *Messenger, event events.Event) events.Event {
+	for i := 0; i < 100; i++ {
+		from.SendEvent(event)
+
+		timeout := time.After(20 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case received := <-to.events:
+				// earlier attempts may still be arriving
+				if received.Value == event.Value {
+					return received
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+
+	t.Fatal("event wasn't routed")
+	return events.Event{}
+}
+
+func TestMessengerRouter(t *testing.T) {
+	server := newRouter()
+	defer server.Close()
+
+	address := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	from, err := newMessenger(address, 10*time.Millisecond)
+	assert.Nil(t, err)
+	to, err := newMessenger(address, 10*time.Millisecond)
+	assert.Nil(t, err)
+
+	to.SubscribeToRooms("ITB-1101")
+	assert.Eventually(t, from.Connected, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, to.Connected, time.Second, 10*time.Millisecond)
+
+	event := events.Event{Key: "power", Value: "on", AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1101"}}
+	assert.Equal(t, "on", routed(t, from, to, event).Value)
+
+	// the router drops the subscription with the connection, so it only routes to the
+	// room again once the messenger resubscribes
+	to.mu.Lock()
+	to.conn.Close()
+	to.mu.Unlock()
+
+	assert.Equal(t, false, nextChange(t, to))
+	assert.Equal(t, true, nextChange(t, to))
+
+	event.Value = "standby"
+	assert.Equal(t, "standby", routed(t, from, to, event).Value)
+}
+
+func TestNewMessengerAddress(t *testing.T) {
+	_, err := NewMessenger("")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,84 @@
+package hub
+
+import (
+	"sync"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// Memory is an in-memory EventSource and EventSink. Events sent to it are received
+// by its readers if their affected room has been subscribed to.
+type Memory struct {
+	events  chan events.Event
+	changes chan bool
+
+	mu           sync.Mutex
+	rooms        map[string]bool
+	disconnected bool
+}
+
+// NewMemory returns a Memory that buffers up to size events
+func NewMemory(size int) *Memory {
+	return &Memory{
+		events:  make(chan events.Event, size),
+		changes: make(chan bool, 10),
+		rooms:   make(map[string]bool),
+	}
+}
+
+// SubscribeToRooms implements EventSource
+func (m *Memory) SubscribeToRooms(rooms ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, room := range rooms {
+		m.rooms[room] = true
+	}
+}
+
+// ReceiveEvent implements EventSource
+func (m *Memory) ReceiveEvent() events.Event {
+	return <-m.events
+}
+
+// SendEvent implements EventSink. It blocks if the buffer is full.
+func (m *Memory) SendEvent(event events.Event) {
+	m.mu.Lock()
+	subscribed := m.rooms[event.AffectedRoom.RoomID]
+	m.mu.Unlock()
+
+	if subscribed {
+		m.events <- event
+	}
+}
+
+// ConnectionChanges implements Connection
+func (m *Memory) ConnectionChanges() <-chan bool {
+	return m.changes
+}
+
+// Connected implements Connection
+func (m *Memory) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return !m.disconnected
+}
+
+// Disconnect reports that the connection was lost
+func (m *Memory) Disconnect() {
+	m.mu.Lock()
+	m.disconnected = true
+	m.mu.Unlock()
+
+	m.changes <- false
+}
+
+// Reconnect reports that the connection was restored
+func (m *Memory) Reconnect() {
+	m.mu.Lock()
+	m.disconnected = false
+	m.mu.Unlock()
+
+	m.changes <- true
+}
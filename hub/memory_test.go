@@ -0,0 +1,32 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(10)
+	m.SubscribeToRooms("ITB-1101")
+
+	m.SendEvent(events.Event{Key: "input", AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1102"}})
+	m.SendEvent(events.Event{Key: "power", AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1101"}})
+
+	assert.Equal(t, "power", m.ReceiveEvent().Key)
+	assert.Equal(t, 0, len(m.events))
+}
+
+func TestMemoryConnectionChanges(t *testing.T) {
+	m := NewMemory(10)
+
+	assert.Equal(t, true, m.Connected())
+	m.Disconnect()
+	assert.Equal(t, false, m.Connected())
+	m.Reconnect()
+	assert.Equal(t, true, m.Connected())
+
+	assert.Equal(t, false, <-m.ConnectionChanges())
+	assert.Equal(t, true, <-m.ConnectionChanges())
+}
@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultMQTTTopic is the topic pattern used when none is given to NewMQTT
+const DefaultMQTTTopic = "av/{building}/{room}/events"
+
+// MQTT is an EventSource and EventSink backed by an MQTT broker. Each room's events
+// are JSON encoded events.Event values published on a topic built from a pattern.
+type MQTT struct {
+	client  mqtt.Client
+	pattern string
+	events  chan events.Event
+	changes chan bool
+
+	mu            sync.Mutex
+	rooms         map[string]bool
+	connected     bool
+	everConnected bool
+}
+
+// NewMQTT connects to the broker at address (e.g. tcp://broker:1883), retrying in the
+// background if the broker can't be reached. pattern is the
+// topic each room's events are published on, where {building} and {room} are replaced
+// with the building id and full room id.
+func NewMQTT(address, clientID, pattern string) (*MQTT, error) {
+	if pattern == "" {
+		pattern = DefaultMQTTTopic
+	}
+
+	m := &MQTT{
+		pattern: pattern,
+		events:  make(chan events.Event, 5000),
+		changes: make(chan bool, 10),
+		rooms:   make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(address).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(m.onConnectionLost)
+
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.WaitTimeout(time.Second) && token.Error() != nil {
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s: %w", address, token.Error())
+	}
+
+	return m, nil
+}
+
+// Topic returns the topic for room's events
+func (m *MQTT) Topic(room string) string {
+	building := strings.Split(room, "-")[0]
+	return strings.NewReplacer("{building}", building, "{room}", room).Replace(m.pattern)
+}
+
+// SubscribeToRooms implements EventSource
+func (m *MQTT) SubscribeToRooms(rooms ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, room := range rooms {
+		m.rooms[room] = true
+		if m.connected {
+			m.client.Subscribe(m.Topic(room), 1, m.handler(room))
+		}
+	}
+}
+
+// ReceiveEvent implements EventSource
+func (m *MQTT) ReceiveEvent() events.Event {
+	return <-m.events
+}
+
+// SendEvent implements EventSink
+func (m *MQTT) SendEvent(event events.Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	m.client.Publish(m.Topic(event.AffectedRoom.RoomID), 1, false, b)
+}
+
+// Connected implements Connection
+func (m *MQTT) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.connected
+}
+
+// ConnectionChanges implements Connection
+func (m *MQTT) ConnectionChanges() <-chan bool {
+	return m.changes
+}
+
+// onConnect subscribes to every room again, since subscriptions don't survive a reconnect
+func (m *MQTT) onConnect(client mqtt.Client) {
+	m.mu.Lock()
+	reconnect := m.everConnected
+	m.connected = true
+	m.everConnected = true
+	for room := range m.rooms {
+		client.Subscribe(m.Topic(room), 1, m.handler(room))
+	}
+	m.mu.Unlock()
+
+	if reconnect {
+		m.changes <- true
+	}
+}
+
+func (m *MQTT) onConnectionLost(client mqtt.Client, err error) {
+	m.mu.Lock()
+	m.connected = false
+	m.mu.Unlock()
+
+	m.changes <- false
+}
+
+// handler returns a handler for room's topic, which fills in the event's room if the
+// publisher left it out so events can be told apart when several rooms are subscribed
+func (m *MQTT) handler(room string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		var event events.Event
+		if err := json.Unmarshal(msg.Payload(), &event); err != nil {
+			return
+		}
+
+		if event.AffectedRoom.RoomID == "" {
+			event.AffectedRoom.RoomID = room
+			event.AffectedRoom.BuildingID = strings.Split(room, "-")[0]
+		}
+
+		m.events <- event
+	}
+}
@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMessage struct {
+	payload []byte
+}
+
+func (testMessage) Duplicate() bool   { return false }
+func (testMessage) Qos() byte         { return 1 }
+func (testMessage) Retained() bool    { return false }
+func (testMessage) Topic() string     { return "" }
+func (testMessage) MessageID() uint16 { return 0 }
+func (m testMessage) Payload() []byte { return m.payload }
+func (testMessage) Ack()              {}
+
+func TestMQTTTopic(t *testing.T) {
+	m := &MQTT{pattern: DefaultMQTTTopic}
+	assert.Equal(t, "av/ITB/ITB-1101/events", m.Topic("ITB-1101"))
+
+	m = &MQTT{pattern: "buildings/{building}/rooms/{room}/#"}
+	assert.Equal(t, "buildings/JFSB/rooms/JFSB-B120/#", m.Topic("JFSB-B120"))
+}
+
+func TestMQTTHandle(t *testing.T) {
+	m := &MQTT{events: make(chan events.Event, 10)}
+
+	handle := m.handler("ITB-1101")
+	handle(nil, testMessage{payload: []byte(`not an event`)})
+	handle(nil, testMessage{payload: []byte(`{"key":"input","value":"PC1","target-device":{"deviceID":"ITB-1101-D1"}}`)})
+	handle(nil, testMessage{payload: []byte(`{"key":"muted","affected-room":{"roomID":"ITB-1102"}}`)})
+
+	assert.Equal(t, 2, len(m.events))
+	event := <-m.events
+	assert.Equal(t, "input", event.Key)
+	assert.Equal(t, "ITB-1101-D1", event.TargetDevice.DeviceID)
+	assert.Equal(t, "ITB-1101", event.AffectedRoom.RoomID, "the room should be taken from the topic")
+
+	event = <-m.events
+	assert.Equal(t, "ITB-1102", event.AffectedRoom.RoomID)
+}
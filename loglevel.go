@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultLevelDuration is how long a log level change lasts if no duration is given
+const defaultLevelDuration = 30 * time.Minute
+
+// levelControl changes the log level at runtime, reverting to the configured level
+// after a while so debug logging isn't left on by accident
+type levelControl struct {
+	level   zap.AtomicLevel
+	initial zapcore.Level
+	log     *zap.Logger
+
+	mu       sync.Mutex
+	revert   *time.Timer
+	revertAt time.Time
+}
+
+type levelStatus struct {
+	Level    string     `json:"level"`
+	RevertAt *time.Time `json:"revertAt,omitempty"`
+}
+
+func newLevelControl(config zap.Config, log *zap.Logger) *levelControl {
+	return &levelControl{
+		level:   config.Level,
+		initial: config.Level.Level(),
+		log:     log,
+	}
+}
+
+// set changes the log level for d, or for defaultLevelDuration if d is 0
+func (l *levelControl) set(level zapcore.Level, d time.Duration) {
+	if d <= 0 {
+		d = defaultLevelDuration
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.log.Info("changing log level", zap.String("level", level.String()), zap.Duration("for", d))
+	l.level.SetLevel(level)
+
+	if l.revert != nil {
+		l.revert.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// the level was changed again while the timer was firing
+		if l.revert != timer {
+			return
+		}
+
+		l.reset()
+	})
+
+	l.revert = timer
+	l.revertAt = time.Now().Add(d)
+}
+
+// restore reverts to the configured log level now
+func (l *levelControl) restore() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.revert != nil {
+		l.revert.Stop()
+	}
+	l.reset()
+}
+
+func (l *levelControl) reset() {
+	l.revert = nil
+	l.revertAt = time.Time{}
+	l.level.SetLevel(l.initial)
+	l.log.Info("reverted log level", zap.String("level", l.initial.String()))
+}
+
+func (l *levelControl) status() levelStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := levelStatus{Level: l.level.Level().String()}
+	if l.revert != nil {
+		revertAt := l.revertAt
+		status.RevertAt = &revertAt
+	}
+
+	return status
+}
+
+// handleEvent changes the log level from a "log-level" event, whose value is the level
+// optionally followed by how long to keep it, e.g. "debug 15m". Returns false if the event
+// isn't a log level event.
+func (l *levelControl) handleEvent(event events.Event) bool {
+	if event.Key != "log-level" {
+		return false
+	}
+
+	level, d, err := parseLevelChange(event.Value)
+	if err != nil {
+		l.log.Warn("invalid log level event", zap.String("value", event.Value), zap.Error(err))
+		return true
+	}
+
+	l.set(level, d)
+	return true
+}
+
+// parseLevelChange parses "<level> [duration]"
+func parseLevelChange(value string) (zapcore.Level, time.Duration, error) {
+	var level zapcore.Level
+	var d time.Duration
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return level, d, fmt.Errorf("expected a level and an optional duration")
+	}
+
+	if err := level.Set(fields[0]); err != nil {
+		return level, d, err
+	}
+
+	if len(fields) == 2 {
+		var err error
+		if d, err = time.ParseDuration(fields[1]); err != nil {
+			return level, d, err
+		}
+	}
+
+	return level, d, nil
+}
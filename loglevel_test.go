@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func testLevelControl() *levelControl {
+	return newLevelControl(zap.Config{Level: zap.NewAtomicLevelAt(zapcore.InfoLevel)}, zap.NewNop())
+}
+
+func TestParseLevelChange(t *testing.T) {
+	tests := []struct {
+		value string
+		level zapcore.Level
+		d     time.Duration
+		err   bool
+	}{
+		{value: "debug", level: zapcore.DebugLevel},
+		{value: "warn 15m", level: zapcore.WarnLevel, d: 15 * time.Minute},
+		{value: "  error   1h  ", level: zapcore.ErrorLevel, d: time.Hour},
+		{value: "", err: true},
+		{value: "loud", err: true},
+		{value: "debug soon", err: true},
+		{value: "debug 15m extra", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			level, d, err := parseLevelChange(tt.value)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.level, level)
+			assert.Equal(t, tt.d, d)
+		})
+	}
+}
+
+func TestLevelHandleEvent(t *testing.T) {
+	l := testLevelControl()
+
+	// other events are left for the room managers
+	assert.Equal(t, false, l.handleEvent(events.Event{Key: "power", Value: "on"}))
+	assert.Equal(t, "info", l.status().Level)
+
+	// an invalid log level event is still a log level event
+	assert.Equal(t, true, l.handleEvent(events.Event{Key: "log-level", Value: "loud"}))
+	assert.Equal(t, "info", l.status().Level)
+
+	assert.Equal(t, true, l.handleEvent(events.Event{Key: "log-level", Value: "debug 10m"}))
+	status := l.status()
+	assert.Equal(t, "debug", status.Level)
+	if assert.NotNil(t, status.RevertAt) {
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), *status.RevertAt, time.Second)
+	}
+
+	// without a duration the change lasts defaultLevelDuration
+	assert.Equal(t, true, l.handleEvent(events.Event{Key: "log-level", Value: "warn"}))
+	assert.WithinDuration(t, time.Now().Add(defaultLevelDuration), *l.status().RevertAt, time.Second)
+	l.restore()
+}
+
+func TestLevelRevert(t *testing.T) {
+	l := testLevelControl()
+
+	l.set(zapcore.DebugLevel, 20*time.Millisecond)
+	assert.Equal(t, true, l.level.Enabled(zapcore.DebugLevel))
+
+	assert.Eventually(t, func() bool {
+		return l.status() == levelStatus{Level: "info"}
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestLevelRestore(t *testing.T) {
+	l := testLevelControl()
+
+	l.set(zapcore.DebugLevel, 30*time.Millisecond)
+	l.restore()
+	assert.Equal(t, levelStatus{Level: "info"}, l.status())
+
+	// the cancelled revert doesn't undo a later change
+	l.set(zapcore.WarnLevel, time.Hour)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, "warn", l.status().Level)
+	l.restore()
+}
@@ -1,110 +1,348 @@
 package main
 
 import (
-	"encoding/json"
+	"expvar"
 	"fmt"
-	"io"
-	"net/http"
+	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/byuoitav/mute-service/audit"
+	"github.com/byuoitav/mute-service/client"
+	"github.com/byuoitav/mute-service/direct"
+	"github.com/byuoitav/mute-service/hub"
+	"github.com/byuoitav/mute-service/roomconfig"
 	"github.com/byuoitav/mute-service/state"
 
-	"github.com/byuoitav/central-event-system/hub/base"
-	"github.com/byuoitav/central-event-system/messenger"
 	"github.com/byuoitav/common/v2/events"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
 
 func main() {
-	var (
-		logLevel   string
-		deviceID   string
-		hubAddress string
-		apiAddress string
-		dbAddress  string
-	)
-
-	pflag.StringVarP(&logLevel, "log-level", "L", "info", "Level at which the logger operates. Refer to https://godoc.org/go.uber.org/zap/zapcore#Level for options")
-	pflag.StringVarP(&deviceID, "device-id", "", "", "Device id as found in couch")
-	pflag.StringVarP(&hubAddress, "hub-address", "", "", "Address of the event hub")
-	pflag.StringVarP(&apiAddress, "av-api", "", "", "Address of the av-api")
-	pflag.StringVarP(&dbAddress, "db-address", "", "", "Address of the room database")
-	pflag.Parse()
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"replay":          replay,
+			"simulate":        simulate,
+			"validate-config": validateConfig,
+		}
+
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// settings are checked before the logger is built, since the log level is one of them
+	flags, cfg := newFlags(os.Args[0], pflag.ExitOnError)
+	if err := loadSettings(flags, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load settings: %s\n", err)
+		os.Exit(1)
+	} else if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	//set up logger
-	_, log := logger(logLevel)
+	logConfig, log := logger(cfg.logLevel)
 	defer log.Sync()
+	levels := newLevelControl(logConfig, log)
+
+	dbOpts, apiOpts, err := buildClients(cfg.dbFlags, cfg.apiFlags, cfg.secrets)
+	if err != nil {
+		log.Fatal("failed to load credentials", zap.Error(err))
+	}
+
+	dbClient, err := client.New(dbOpts)
+	if err != nil {
+		log.Fatal("failed to build room database client", zap.Error(err))
+	}
+
+	apiClient, err := client.New(apiOpts)
+	if err != nil {
+		log.Fatal("failed to build av-api client", zap.Error(err))
+	}
+
+	dbClient.Timeout = cfg.timeout
+	apiClient.Timeout = cfg.timeout
+
+	var rooms roomconfig.Provider = &roomconfig.Database{Address: cfg.dbAddress, Client: dbClient}
+	if cfg.roomFile != "" {
+		rooms = &roomconfig.File{Path: cfg.roomFile}
+	}
 
-	if deviceID == "" {
-		log.Fatal("Device ID required. Use --device-id to provide the id of the device")
-	} else if hubAddress == "" {
-		log.Fatal("Event hub address required. Use --hub-address to provide the address of the event hub")
-	} else if apiAddress == "" {
-		log.Fatal("AV API address required. Use --av-api to provide the address of the av-api")
-	}
-
-	log.Info("Checking room configuration")
-	cancel, err := cancelConditions(dbAddress, deviceID)
-	if cancel {
-		log.Info("cancel conditions met; sleeping...")
-		for cancel {
-			time.Sleep(300 * time.Second)
-			if err != nil { // in the event of an error when accessing the room config, check again in 5 min
-				cancel, err = cancelConditions(dbAddress, deviceID)
+	roomIDs := cfg.roomList
+	if cfg.multiRoom() {
+		if cfg.building != "" {
+			retry(log, "room configuration", 5*time.Minute, func() error {
+				ids, err := buildingRooms(rooms, cfg.building)
+				roomIDs = append(cfg.roomList, ids...)
+				return err
+			})
+		}
+		log.Info("Managing rooms", zap.Strings("rooms", roomIDs))
+	} else {
+		log.Info("Checking room configuration")
+		cancel, err := cancelConditions(rooms, cfg.deviceID)
+		if cancel {
+			log.Info("cancel conditions met; sleeping...", zap.NamedError("reason", err))
+			for cancel {
+				time.Sleep(300 * time.Second)
+				if err != nil { // in the event of an error when accessing the room config, check again in 5 min
+					cancel, err = cancelConditions(rooms, cfg.deviceID)
+				}
 			}
 		}
+
+		roomID, err := parseDeviceID(cfg.deviceID)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("invalid device id: %s", cfg.deviceID), zap.Error(err))
+		}
+		roomIDs = []string{roomID}
 	}
 
-	roomID, err := parseDeviceID(deviceID)
-	if err != nil {
-		log.Fatal(fmt.Sprintf("invalid device id: %s", deviceID), zap.Error(err))
+	decisions := &audit.Log{
+		Path:       cfg.auditLog,
+		MaxBytes:   cfg.auditSize * 1024 * 1024,
+		MaxBackups: cfg.auditKeep,
+		Keep:       500,
+		Log:        log,
+	}
+	if err := decisions.Open(); err != nil {
+		log.Error("failed to open decision log, keeping decisions in memory only", zap.Error(err))
+	}
+	defer decisions.Close()
+
+	var backend state.Backend = &state.AVAPI{
+		Address: cfg.apiAddress,
+		Client:  apiClient,
+		Log:     log,
+	}
+	if cfg.control == "direct" {
+		config, err := direct.Load(cfg.directFile)
+		if err != nil {
+			log.Fatal("failed to load direct control config", zap.Error(err))
+		}
+
+		backend = &direct.Backend{
+			Config: config,
+			Log:    log,
+		}
 	}
 
-	roomManager := &state.RoomStateManager{
-		Log:                log,
-		RoomID:             roomID,
-		AvApiAddress:       apiAddress,
-		RoomState:          nil,
-		AudioPriorityCache: make(map[string]string),
+	backend = &state.Breaker{
+		Backend:  backend,
+		Failures: cfg.failures,
+		Cooldown: cfg.retryAfter,
+		Log:      log,
 	}
 
-	// initialize room state on start up
-	log.Info("Initializing the room on startup")
-	if err := roomManager.InitializeRoomState(); err != nil {
-		log.Fatal("failed to initialize room", zap.Error(err))
+	managers := make(roomManagers)
+	for _, roomID := range roomIDs {
+		managers[roomID] = &state.RoomStateManager{
+			Log:                log.With(zap.String("room", roomID)),
+			RoomID:             roomID,
+			AvApiAddress:       cfg.apiAddress,
+			RoomState:          nil,
+			AudioPriorityCache: make(map[string]string),
+			WarmupPeriod:       cfg.warmup,
+			CooldownPeriod:     cfg.cooldown,
+			Policy:             state.Policy(cfg.policy),
+			AdoptUnmuted:       cfg.adopt,
+			Recorder:           decisions,
+			Backend:            backend,
+			RoomConfig:         rooms,
+		}
 	}
+	expvar.Publish("stale_events", staleEvents(managers))
 
-	// connect to the event hub
-	log.Info("Starting event hub messenger")
-	eventMessenger, nerr := messenger.BuildMessenger(hubAddress, base.Messenger, 5000)
-	if nerr != nil {
-		log.Fatal("failed to build event hub messenger", zap.Error(nerr))
+	ready := &readiness{}
+	srv := &server{
+		log:       log,
+		rooms:     managers,
+		decisions: decisions,
+		status:    ready,
+		levels:    levels,
 	}
+	go srv.serve(cfg.port)
+
+	// connect to the event hub. both sources keep retrying in the background until they connect
+	var source hub.EventSource
+	if cfg.transport == "mqtt" {
+		clientID := cfg.deviceID
+		if clientID == "" {
+			clientID, _ = os.Hostname()
+		}
+
+		log.Info("Connecting to MQTT broker", zap.String("broker", cfg.mqttBroker))
+		source, err = hub.NewMQTT(cfg.mqttBroker, "mute-service-"+clientID, cfg.mqttTopic)
+		if err != nil {
+			log.Fatal("failed to connect to MQTT broker", zap.Error(err))
+		}
+	} else {
+		log.Info("Starting event hub messenger")
+		source, err = hub.NewMessenger(cfg.hubAddress)
+		if err != nil {
+			log.Fatal("failed to build event hub messenger", zap.Error(err))
+		}
+	}
+
+	// load each room on start up, waiting for the av-api if it isn't up yet. events for
+	// rooms that haven't loaded yet are ignored, so one slow room doesn't hold up the rest.
+	// each room is resolved once it is loaded and the hub is up, so nothing is changed
+	// before the service can hear about what happens next.
+	log.Info("Initializing rooms on startup")
+	hubUp := make(chan struct{})
+	var initialized sync.WaitGroup
+	for _, roomManager := range managers {
+		initialized.Add(1)
+		go func(roomManager *state.RoomStateManager) {
+			retry(roomManager.Log, "av-api", time.Minute, roomManager.LoadRoomState)
+			initialized.Done()
+
+			<-hubUp
+			if err := roomManager.ResolveStartup(); err != nil {
+				roomManager.Log.Warn("failed to resolve room on startup", zap.Error(err))
+			}
+		}(roomManager)
+	}
+
+	go func() {
+		initialized.Wait()
+		ready.setAVAPI(true)
+	}()
+
+	if conn, ok := source.(hub.Connection); ok {
+		retry(log, "event hub", time.Minute, func() error {
+			if !conn.Connected() {
+				return fmt.Errorf("not connected")
+			}
+			return nil
+		})
+	}
+	ready.setHub(true)
+	hubConnected.Set(1)
+
+	go watchConnection(source, managers, ready, log)
 
 	// subscribe to and receive events from the hub
 	log.Info("Listening for room events")
-	eventMessenger.SubscribeToRooms(roomID)
+	source.SubscribeToRooms(roomIDs...)
+	close(hubUp)
 
+	listen(source, managers, levels, log)
+}
+
+// retry calls f until it succeeds, waiting between attempts with an exponential backoff of at most max
+func retry(log *zap.Logger, name string, max time.Duration, f func() error) {
+	wait := time.Second
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+
+		log.Warn(fmt.Sprintf("%s not available yet", name), zap.Error(err), zap.Duration("retryIn", wait))
+		time.Sleep(wait)
+
+		if wait *= 2; wait > max {
+			wait = max
+		}
+	}
+}
+
+// roomManagers is the manager of each room the service manages, keyed by room id
+type roomManagers map[string]*state.RoomStateManager
+
+// listen hands every relevant event from source to the manager of its room, and log
+// level events to levels if it isn't nil
+func listen(source hub.EventSource, managers roomManagers, levels *levelControl, log *zap.Logger) {
 	for {
-		event := eventMessenger.ReceiveEvent()
-		if checkEvent(event) {
-			log.Debug(fmt.Sprintf("handling event of type: %s", event.Key))
+		event := source.ReceiveEvent()
+		if levels != nil && levels.handleEvent(event) {
+			continue
+		}
+
+		if !checkEvent(event) {
+			continue
+		}
+
+		roomManager, ok := managers[event.AffectedRoom.RoomID]
+		if !ok {
+			log.Debug("ignoring event for unmanaged room", zap.String("room", event.AffectedRoom.RoomID))
+			continue
+		}
+
+		log.Debug(fmt.Sprintf("handling event of type: %s", event.Key), zap.String("room", event.AffectedRoom.RoomID))
+		roomManager.HandleEvent(event)
+	}
+}
+
+// watchConnection resyncs the room every time the event source reconnects,
+// since any events sent while it was disconnected were missed
+func watchConnection(source hub.EventSource, managers roomManagers, ready *readiness, log *zap.Logger) {
+	conn, ok := source.(hub.Connection)
+	if !ok {
+		return
+	}
+
+	for connected := range conn.ConnectionChanges() {
+		if !connected {
+			log.Warn("lost connection to the event hub")
+			hubConnected.Set(0)
+			ready.setHub(false)
+			continue
+		}
 
-			roomManager.HandleEvent(event)
+		log.Info("reconnected to the event hub, resyncing rooms")
+		hubConnected.Set(1)
+		hubReconnects.Add(1)
+		ready.setHub(true)
+
+		for roomID, roomManager := range managers {
+			if err := roomManager.Resync(); err != nil {
+				log.Error("failed to resync room after reconnecting", zap.String("room", roomID), zap.Error(err))
+			}
 		}
 	}
 }
 
 func checkEvent(event events.Event) bool {
-	return event.Key == "muted" || event.Key == "input" || event.Key == "power" || event.Value == "master volume mute on display page" || event.Value == "master volume set on display page"
+	return event.Key == "muted" || event.Key == "input" || event.Key == "power" || event.Value == "master volume mute on display page" || event.Value == "master volume unmute on display page" || event.Value == "master volume set on display page"
+}
+
+// buildingRooms returns the rooms in building with auto mute enabled
+func buildingRooms(rooms roomconfig.Provider, building string) ([]string, error) {
+	lister, ok := rooms.(roomconfig.Lister)
+	if !ok {
+		return nil, fmt.Errorf("room configuration can't list the rooms in a building")
+	}
+
+	configs, err := lister.Rooms(building)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id, config := range configs {
+		if config.AutoMute {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
 }
 
-func cancelConditions(dbAddress, deviceID string) (bool, error) {
+func cancelConditions(rooms roomconfig.Provider, deviceID string) (bool, error) {
 	if checkForControlPi(deviceID) {
-		status, err := checkRoomConfig(dbAddress, deviceID)
+		status, err := checkRoomConfig(rooms, deviceID)
 		return !status, err
 	}
 	return true, nil
@@ -115,37 +353,18 @@ func checkForControlPi(deviceID string) bool {
 	return found
 }
 
-func checkRoomConfig(dbAddress, deviceID string) (bool, error) {
+func checkRoomConfig(rooms roomconfig.Provider, deviceID string) (bool, error) {
 	roomID, err := parseDeviceID(deviceID)
 	if err != nil {
 		return false, err
 	}
 
-	resp, err := http.Get("http://" + dbAddress + "/rooms/" + roomID)
+	config, err := rooms.RoomConfig(roomID)
 	if err != nil {
 		return false, err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
-	}
-
-	type configuration struct {
-		AutoMute bool `json:"autoMute"`
-	}
-
-	type roomConfig struct {
-		Config configuration `json:"configuration"`
-	}
-
-	var config roomConfig
-	if err = json.Unmarshal(body, &config); err != nil {
-		return false, err
-	}
 
-	return config.Config.AutoMute, nil
+	return config.AutoMute, nil
 }
 
 func parseDeviceID(id string) (string, error) {
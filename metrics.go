@@ -0,0 +1,20 @@
+package main
+
+import "expvar"
+
+var (
+	hubConnected  = expvar.NewInt("hub_connected")
+	hubReconnects = expvar.NewInt("hub_reconnects")
+)
+
+// staleEvents reports how many out of date events each room has dropped, keyed by room id
+func staleEvents(managers roomManagers) expvar.Func {
+	return func() interface{} {
+		stale := make(map[string]int, len(managers))
+		for roomID, roomManager := range managers {
+			stale[roomID] = roomManager.StaleEvents()
+		}
+
+		return stale
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleEvents(t *testing.T) {
+	s, _ := testServer(t)
+
+	// an event from before the room was loaded is dropped
+	s.rooms["ITB-1108A"].HandleEvent(events.Event{
+		Key:          "muted",
+		Value:        "true",
+		Timestamp:    time.Now().Add(-time.Minute),
+		TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D1"},
+		AffectedRoom: events.BasicRoomInfo{RoomID: "ITB-1108A"},
+	})
+
+	assert.Equal(t, map[string]int{"ITB-1108A": 1, "ITB-1101": 0}, staleEvents(s.rooms)())
+	assert.Equal(t, `{"ITB-1101":0,"ITB-1108A":1}`, staleEvents(s.rooms).String())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/state"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// replay runs recorded events through a RoomStateManager against a fake av-api,
+// printing every PUT the manager makes and the final state of the room
+func replay(args []string) error {
+	return runReplay(args, os.Stdout)
+}
+
+// runReplay replays the events, writing the PUTs and the final state to out
+func runReplay(args []string, out io.Writer) error {
+	var (
+		logLevel  string
+		stateFile string
+		roomID    string
+		policy    string
+		warmup    time.Duration
+		cooldown  time.Duration
+	)
+
+	flags := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	flags.StringVarP(&logLevel, "log-level", "L", "warn", "Level at which the logger operates")
+	flags.StringVarP(&stateFile, "state", "s", "", "File containing the initial room state, as returned by the av-api")
+	flags.StringVarP(&roomID, "room", "r", "", "Room id to replay as. Defaults to the room of the first event")
+	flags.StringVarP(&policy, "policy", "", string(state.PolicySticky), "How the audio display is chosen for an input shown on several displays: sticky or lowest-display-number")
+	flags.DurationVarP(&warmup, "warmup", "", 0, "How long to wait after a display powers on before resolving the room. Unlike the service, the default is to not wait")
+	flags.DurationVarP(&cooldown, "cooldown", "", 0, "How long to wait after every display is in standby before forgetting the room's audio preferences. Unlike the service, the default is to not wait")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay --state <file> <events file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if stateFile == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("an initial state and an events file are required")
+	}
+
+	if !state.Policy(policy).Valid() {
+		return fmt.Errorf("invalid policy %q, use sticky or lowest-display-number", policy)
+	}
+
+	_, log := logger(logLevel)
+	defer log.Sync()
+
+	var initial avapitest.Room
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		return fmt.Errorf("unable to read initial state: %w", err)
+	}
+	if err := json.Unmarshal(b, &initial); err != nil {
+		return fmt.Errorf("unable to parse initial state: %w", err)
+	}
+
+	recorded, err := readEvents(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if roomID == "" {
+		for _, event := range recorded {
+			if event.AffectedRoom.RoomID != "" {
+				roomID = event.AffectedRoom.RoomID
+				break
+			}
+		}
+	}
+	if roomID == "" {
+		return fmt.Errorf("unable to determine the room id, use --room to provide it")
+	}
+
+	avapi := avapitest.NewServer(initial)
+	defer avapi.Close()
+
+	avapi.OnPut = func(path string, body []byte) {
+		fmt.Fprintf(out, "PUT %s %s\n", path, body)
+	}
+
+	manager := &state.RoomStateManager{
+		Log:                log,
+		RoomID:             roomID,
+		AvApiAddress:       avapi.Address(),
+		AudioPriorityCache: make(map[string]string),
+		Policy:             state.Policy(policy),
+		WarmupPeriod:       warmup,
+		CooldownPeriod:     cooldown,
+	}
+
+	if err := manager.InitializeRoomState(); err != nil {
+		return fmt.Errorf("unable to initialize room: %w", err)
+	}
+
+	shiftTimestamps(recorded, time.Now())
+
+	for _, event := range recorded {
+		avapi.Apply(event)
+		if checkEvent(event) {
+			log.Debug("replaying event", zap.String("key", event.Key), zap.String("value", event.Value))
+			manager.HandleEvent(event)
+		}
+	}
+
+	// events are replayed back to back, so a warm-up or cool-down started by them is
+	// waited out before the room's final state is printed
+	for p := manager.PowerState(); p == state.PowerWarming || p == state.PowerCooling; p = manager.PowerState() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	final, _ := json.MarshalIndent(avapi.Room(), "", "  ")
+	fmt.Fprintf(out, "final state:\n%s\n", final)
+
+	if stale := manager.StaleEvents(); stale > 0 {
+		fmt.Fprintf(out, "stale events dropped: %d\n", stale)
+	}
+
+	return nil
+}
+
+// shiftTimestamps shifts the recorded timestamps so that the first event happens a
+// second after now, keeping the gaps between events. Events without a timestamp are left alone.
+func shiftTimestamps(recorded []events.Event, now time.Time) {
+	var offset time.Duration
+	for _, event := range recorded {
+		if !event.Timestamp.IsZero() {
+			offset = now.Sub(event.Timestamp) + time.Second
+			break
+		}
+	}
+
+	for i := range recorded {
+		if !recorded[i].Timestamp.IsZero() {
+			recorded[i].Timestamp = recorded[i].Timestamp.Add(offset)
+		}
+	}
+}
+
+// readEvents reads a file of events.Event values, one JSON object per line
+func readEvents(path string) ([]events.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open events: %w", err)
+	}
+	defer f.Close()
+
+	var recorded []events.Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("unable to parse event on line %d: %w", line, err)
+		}
+		recorded = append(recorded, event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read events: %w", err)
+	}
+
+	return recorded, nil
+}
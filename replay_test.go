@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestReadEvents(t *testing.T) {
+	path := writeFile(t, "events.jsonl", `{"key":"power","value":"on"}
+
+{"key":"input","value":"VIA1"}
+`)
+
+	recorded, err := readEvents(path)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(recorded)) {
+		assert.Equal(t, "power", recorded[0].Key)
+		assert.Equal(t, "input", recorded[1].Key)
+	}
+
+	path = writeFile(t, "events.jsonl", `{"key":"power","value":"on"}
+
+{"key":"input",
+`)
+
+	_, err = readEvents(path)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "line 3")
+	}
+
+	_, err = readEvents(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.NotNil(t, err)
+}
+
+func TestShiftTimestamps(t *testing.T) {
+	recorded := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	evs := []events.Event{
+		{Key: "no timestamp"},
+		{Key: "first", Timestamp: recorded},
+		{Key: "second", Timestamp: recorded.Add(5 * time.Second)},
+	}
+
+	shiftTimestamps(evs, now)
+
+	assert.True(t, evs[0].Timestamp.IsZero())
+	assert.Equal(t, now.Add(time.Second), evs[1].Timestamp)
+	assert.Equal(t, now.Add(6*time.Second), evs[2].Timestamp, "the gaps between events are kept")
+}
+
+func TestReplay(t *testing.T) {
+	initial, _ := json.Marshal(avapitest.Room{
+		Displays: []avapitest.Display{{Name: "D1"}, {Name: "D2"}},
+		AudioDevices: []avapitest.AudioDevice{
+			{Name: "D1", Power: "on", Input: "VIA1"},
+			{Name: "D2", Power: "standby", Input: "VIA1"},
+		},
+	})
+	stateFile := writeFile(t, "room.json", string(initial))
+
+	// D2 powers on, and a late event from before that is dropped as stale
+	eventsFile := writeFile(t, "events.jsonl", `{"key":"power","value":"on","timestamp":"2020-01-02T10:00:05Z","target-device":{"deviceID":"ITB-1108A-D2"},"affected-room":{"roomID":"ITB-1108A"}}
+{"key":"power","value":"standby","timestamp":"2020-01-02T10:00:00Z","target-device":{"deviceID":"ITB-1108A-D2"},"affected-room":{"roomID":"ITB-1108A"}}
+`)
+
+	var out syncBuffer
+	assert.Nil(t, runReplay([]string{"--state", stateFile, "--warmup", "20ms", eventsFile}, &out))
+	output := out.String()
+
+	// every PUT is printed: D1 alone on startup, then D2 muted once it has warmed up
+	var puts []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "PUT ") {
+			puts = append(puts, line)
+		}
+	}
+	assert.Equal(t, []string{
+		`PUT /buildings/ITB/rooms/1108A {"displays":[{"name":"D1"},{"name":"D2"}],"audioDevices":[{"name":"D1","muted":false}]}`,
+		`PUT /buildings/ITB/rooms/1108A {"displays":[{"name":"D1"},{"name":"D2"}],"audioDevices":[{"name":"D1","muted":false},{"name":"D2","muted":true}]}`,
+	}, puts)
+
+	i := strings.Index(output, "final state:\n")
+	if assert.True(t, i >= 0, "no final state was printed") {
+		var final avapitest.Room
+		assert.Nil(t, json.NewDecoder(strings.NewReader(output[i+len("final state:\n"):])).Decode(&final))
+		assert.Equal(t, avapitest.Room{
+			Displays: []avapitest.Display{{Name: "D1"}, {Name: "D2"}},
+			AudioDevices: []avapitest.AudioDevice{
+				{Name: "D1", Power: "on", Input: "VIA1"},
+				{Name: "D2", Power: "on", Input: "VIA1", Muted: true},
+			},
+		}, final)
+	}
+	assert.Contains(t, output, "stale events dropped: 1")
+
+	assert.NotNil(t, runReplay([]string{"--state", stateFile, "--policy", "random", eventsFile}, &out))
+	assert.NotNil(t, runReplay([]string{"--state", stateFile}, &out))
+}
@@ -0,0 +1,195 @@
+// Package roomconfig provides the per-room settings of the mute service.
+package roomconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/byuoitav/mute-service/client"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNotFound is returned when a provider has no configuration for a room
+var ErrNotFound = errors.New("room configuration not found")
+
+// Config is a room's mute service settings
+type Config struct {
+	// AutoMute enables the mute service in the room
+	AutoMute bool `yaml:"autoMute" json:"autoMute"`
+
+	// Excluded is displays that are never muted or unmuted, and aren't counted as
+	// sharing an input with other displays, e.g. confidence monitors
+	Excluded []string `yaml:"excluded" json:"excluded"`
+
+	// AudioDisplays is the display that always plays the audio for an input, keyed by
+	// input (e.g. PC1) or by source, the input without its number (e.g. PC)
+	AudioDisplays map[string]string `yaml:"audioDisplays" json:"audioDisplays"`
+}
+
+// AudioDisplay returns the display configured to play the audio for input, preferring
+// a display configured for the exact input over one configured for its source
+func (c Config) AudioDisplay(input string) (string, bool) {
+	if display, ok := c.AudioDisplays[input]; ok {
+		return display, true
+	}
+
+	display, ok := c.AudioDisplays[strings.TrimRight(input, "0123456789")]
+	return display, ok
+}
+
+// Provider looks up the configuration of a room
+type Provider interface {
+	RoomConfig(roomID string) (Config, error)
+}
+
+// Lister is implemented by providers that can list the rooms in a building
+type Lister interface {
+	// Rooms returns the configuration of every room in building, keyed by room id
+	Rooms(building string) (map[string]Config, error)
+}
+
+var (
+	_ Lister = &Database{}
+	_ Lister = &File{}
+)
+
+// Database reads room configuration from the room database, where it is the
+// configuration field of each room document
+type Database struct {
+	// Address is the host:port of the database, optionally with an http or https scheme
+	Address string
+	// Client is used for requests to the database. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// RoomConfig implements Provider
+func (d *Database) RoomConfig(roomID string) (Config, error) {
+	var r struct {
+		Config Config `json:"configuration"`
+	}
+
+	if err := d.get("/rooms/"+roomID, &r); err != nil {
+		return Config{}, err
+	}
+
+	return r.Config, nil
+}
+
+// Rooms implements Lister. Room documents are keyed by room id, so the rooms in a
+// building are the ones whose ids start with the building id and a dash.
+func (d *Database) Rooms(building string) (map[string]Config, error) {
+	var docs struct {
+		Rows []struct {
+			Doc struct {
+				ID     string `json:"_id"`
+				Config Config `json:"configuration"`
+			} `json:"doc"`
+		} `json:"rows"`
+	}
+
+	query := url.Values{}
+	query.Set("include_docs", "true")
+	query.Set("startkey", fmt.Sprintf("%q", building+"-"))
+	query.Set("endkey", fmt.Sprintf("%q", building+"-\ufff0"))
+
+	if err := d.get("/rooms/_all_docs?"+query.Encode(), &docs); err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]Config, len(docs.Rows))
+	for _, row := range docs.Rows {
+		configs[row.Doc.ID] = row.Doc.Config
+	}
+
+	return configs, nil
+}
+
+// get decodes the JSON document at path into v
+func (d *Database) get(path string, v interface{}) error {
+	c := d.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	resp, err := c.Get(client.URL(d.Address) + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("room database returned %d: %s", resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// File reads room configuration from a local YAML or JSON file with the
+// configuration of each room under rooms, keyed by room id. The file is read
+// on every lookup, so changes apply without a restart.
+type File struct {
+	Path string
+}
+
+// RoomConfig implements Provider
+func (f *File) RoomConfig(roomID string) (Config, error) {
+	rooms, err := f.read()
+	if err != nil {
+		return Config{}, err
+	}
+
+	config, ok := rooms[roomID]
+	if !ok {
+		return Config{}, ErrNotFound
+	}
+
+	return config, nil
+}
+
+// Rooms implements Lister
+func (f *File) Rooms(building string) (map[string]Config, error) {
+	rooms, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]Config)
+	for id, config := range rooms {
+		if strings.HasPrefix(id, building+"-") {
+			configs[id] = config
+		}
+	}
+
+	return configs, nil
+}
+
+func (f *File) read() (map[string]Config, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read room configuration: %w", err)
+	}
+
+	var file struct {
+		Rooms map[string]Config `yaml:"rooms" json:"rooms"`
+	}
+
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse room configuration: %w", err)
+	}
+
+	return file.Rooms, nil
+}
@@ -0,0 +1,150 @@
+package roomconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// couchRooms is the rooms database, keyed by document id
+var couchRooms = map[string]string{
+	"ITB-1101": `{"_id":"ITB-1101","_rev":"1-a","configuration":{"autoMute":true,"excluded":["D3"]}}`,
+	"ITB-1102": `{"_id":"ITB-1102","_rev":"1-b","configuration":{}}`,
+	"ITBX-101": `{"_id":"ITBX-101","_rev":"1-c","configuration":{"autoMute":true}}`,
+}
+
+// allDocs answers a CouchDB _all_docs query with include_docs over couchRooms
+func allDocs(w http.ResponseWriter, r *http.Request) {
+	var start, end string
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("startkey")), &start); err != nil {
+		http.Error(w, `{"error":"bad_request"}`, http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("endkey")), &end); err != nil {
+		http.Error(w, `{"error":"bad_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	var ids []string
+	for id := range couchRooms {
+		if id >= start && id <= end {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var rows []string
+	for _, id := range ids {
+		doc := couchRooms[id]
+		if r.URL.Query().Get("include_docs") != "true" {
+			doc = "null"
+		}
+		rows = append(rows, fmt.Sprintf(`{"id":%q,"key":%q,"value":{"rev":"1"},"doc":%s}`, id, id, doc))
+	}
+
+	fmt.Fprintf(w, `{"total_rows":%d,"offset":0,"rows":[%s]}`, len(couchRooms), strings.Join(rows, ","))
+}
+
+func TestDatabase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rooms/_all_docs" {
+			allDocs(w, r)
+			return
+		}
+
+		doc, ok := couchRooms[strings.TrimPrefix(r.URL.Path, "/rooms/")]
+		if !ok {
+			http.Error(w, `{"error":"not_found","reason":"missing"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	defer server.Close()
+
+	db := &Database{Address: strings.TrimPrefix(server.URL, "http://")}
+
+	config, err := db.RoomConfig("ITB-1101")
+	assert.Nil(t, err)
+	assert.Equal(t, true, config.AutoMute)
+	assert.Equal(t, []string{"D3"}, config.Excluded)
+
+	config, err = db.RoomConfig("ITB-1102")
+	assert.Nil(t, err)
+	assert.Equal(t, false, config.AutoMute)
+
+	_, err = db.RoomConfig("ITB-1103")
+	assert.Equal(t, ErrNotFound, err)
+
+	rooms, err := db.Rooms("ITB")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Config{"ITB-1101": {AutoMute: true, Excluded: []string{"D3"}}, "ITB-1102": {}}, rooms, "rooms of ITBX aren't in ITB")
+
+	// a building with no rooms has none, rather than not being found
+	rooms, err = db.Rooms("JFSB")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rooms))
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	os.WriteFile(path, []byte("rooms:\n  ITB-1101:\n    autoMute: true\n  ITB-1102:\n    autoMute: false\n"), 0644)
+
+	file := &File{Path: path}
+
+	config, err := file.RoomConfig("ITB-1101")
+	assert.Nil(t, err)
+	assert.Equal(t, true, config.AutoMute)
+
+	config, err = file.RoomConfig("ITB-1102")
+	assert.Nil(t, err)
+	assert.Equal(t, false, config.AutoMute)
+
+	_, err = file.RoomConfig("ITB-1103")
+	assert.Equal(t, ErrNotFound, err)
+
+	rooms, err := file.Rooms("ITB")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rooms))
+
+	rooms, err = file.Rooms("IT")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rooms))
+
+	// JSON works too
+	os.WriteFile(path, []byte(`{"rooms":{"ITB-1101":{"autoMute":false}}}`), 0644)
+	config, err = file.RoomConfig("ITB-1101")
+	assert.Nil(t, err)
+	assert.Equal(t, false, config.AutoMute)
+}
+
+func TestAudioDisplay(t *testing.T) {
+	config := Config{
+		AudioDisplays: map[string]string{
+			"PC":   "D3",
+			"PC2":  "D1",
+			"VIA1": "D2",
+		},
+	}
+
+	display, ok := config.AudioDisplay("PC1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "D3", display)
+
+	display, ok = config.AudioDisplay("PC2")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "D1", display, "an exact input should win over its source")
+
+	_, ok = config.AudioDisplay("VIA2")
+	assert.Equal(t, false, ok)
+
+	_, ok = Config{}.AudioDisplay("PC1")
+	assert.Equal(t, false, ok)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/mute-service/audit"
+	"github.com/byuoitav/mute-service/state"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+)
+
+type server struct {
+	log       *zap.Logger
+	rooms     roomManagers
+	decisions *audit.Log
+	status    *readiness
+	levels    *levelControl
+}
+
+// readiness tracks what the service is waiting on before it is managing its rooms. The
+// service is ready once every room has been loaded from the av-api and the event hub is connected.
+type readiness struct {
+	mu      sync.Mutex
+	avAPI   bool
+	hub     bool
+	started bool
+}
+
+type status struct {
+	Ready bool `json:"ready"`
+	AVAPI bool `json:"avApi"`
+	Hub   bool `json:"hub"`
+}
+
+func (r *readiness) setAVAPI(up bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.avAPI = up
+	r.started = r.started || r.avAPI && r.hub
+}
+
+func (r *readiness) setHub(up bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hub = up
+	r.started = r.started || r.avAPI && r.hub
+}
+
+func (r *readiness) status() status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return status{
+		Ready: r.started,
+		AVAPI: r.avAPI,
+		Hub:   r.hub,
+	}
+}
+
+func (s *server) handler() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+
+	e.GET("/status", s.getStatus)
+	e.GET("/rooms/:room/decisions", s.getDecisions)
+	e.GET("/rooms/:room/explain", s.getExplanation)
+	e.GET("/rooms/:room/locks", s.getLocks)
+	e.DELETE("/rooms/:room/locks", s.clearLocks)
+	e.PUT("/rooms/:room/displays/:display/lock/:state", s.lockDisplay)
+	e.DELETE("/rooms/:room/displays/:display/lock", s.unlockDisplay)
+	e.PUT("/rooms/:room/inputs/:input/winner/:display", s.setWinner)
+	e.GET("/log-level", s.getLogLevel)
+	e.PUT("/log-level/:level", s.setLogLevel)
+	e.DELETE("/log-level", s.restoreLogLevel)
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+
+	return e
+}
+
+func (s *server) serve(port int) {
+	s.log.Info("Starting api server", zap.Int("port", port))
+	if err := s.handler().Start(":" + strconv.Itoa(port)); err != nil && err != http.ErrServerClosed {
+		s.log.Error("api server stopped", zap.Error(err))
+	}
+}
+
+// getStatus returns 503 until the service has loaded its rooms from the av-api and
+// connected to the event hub, and 200 after
+func (s *server) getStatus(c echo.Context) error {
+	status := s.status.status()
+	if !status.Ready {
+		return c.JSON(http.StatusServiceUnavailable, status)
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+// getDecisions returns the last n (default 50) decisions made for a room
+func (s *server) getDecisions(c echo.Context) error {
+	room := c.Param("room")
+	if _, ok := s.rooms[room]; !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	n := 50
+	if q := c.QueryParam("n"); q != "" {
+		var err error
+		if n, err = strconv.Atoi(q); err != nil || n < 1 {
+			return c.String(http.StatusBadRequest, "n must be a positive integer")
+		}
+	}
+
+	return c.JSON(http.StatusOK, s.decisions.Recent(room, n))
+}
+
+// getExplanation returns the room's audio layout and why each display was chosen, as
+// JSON or as text with format=text
+func (s *server) getExplanation(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	explanation, err := roomManager.Explain()
+	if err != nil {
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
+
+	if c.QueryParam("format") == "text" {
+		return c.String(http.StatusOK, explanation.String())
+	}
+
+	return c.JSON(http.StatusOK, explanation)
+}
+
+func (s *server) getLocks(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	return c.JSON(http.StatusOK, roomManager.Locks())
+}
+
+// lockDisplay locks a display muted or unmuted, for the duration in for if it is given
+func (s *server) lockDisplay(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	var muted bool
+	switch c.Param("state") {
+	case "muted":
+		muted = true
+	case "unmuted":
+	default:
+		return c.String(http.StatusBadRequest, "state must be muted or unmuted")
+	}
+
+	var d time.Duration
+	if q := c.QueryParam("for"); q != "" {
+		var err error
+		if d, err = time.ParseDuration(q); err != nil || d <= 0 {
+			return c.String(http.StatusBadRequest, "for must be a positive duration")
+		}
+	}
+
+	return s.changed(c, roomManager, roomManager.LockDisplay(c.Param("display"), muted, d))
+}
+
+func (s *server) unlockDisplay(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	return s.changed(c, roomManager, roomManager.UnlockDisplay(c.Param("display")))
+}
+
+func (s *server) clearLocks(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	return s.changed(c, roomManager, roomManager.ClearLocks())
+}
+
+// setWinner makes a display the one that plays the audio for an input
+func (s *server) setWinner(c echo.Context) error {
+	roomManager, ok := s.rooms[c.Param("room")]
+	if !ok {
+		return c.String(http.StatusNotFound, "room not managed by this service")
+	}
+
+	return s.changed(c, roomManager, roomManager.SetWinner(c.Param("input"), c.Param("display")))
+}
+
+// changed responds to a change to a room with the room's locks, or with why the
+// change couldn't be made or applied
+func (s *server) changed(c echo.Context, roomManager *state.RoomStateManager, err error) error {
+	switch {
+	case errors.Is(err, state.ErrNotLoaded):
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, state.ErrUnknownDisplay):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, state.ErrCantWin):
+		return c.String(http.StatusConflict, err.Error())
+	case err != nil:
+		return c.String(http.StatusBadGateway, "the change was saved but couldn't be applied to the room yet: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, roomManager.Locks())
+}
+
+func (s *server) getLogLevel(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.levels.status())
+}
+
+// setLogLevel changes the log level until the duration in for (default 30m) has passed
+func (s *server) setLogLevel(c echo.Context) error {
+	value := c.Param("level")
+	if d := c.QueryParam("for"); d != "" {
+		value += " " + d
+	}
+
+	level, d, err := parseLevelChange(value)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	s.levels.set(level, d)
+	return c.JSON(http.StatusOK, s.levels.status())
+}
+
+// restoreLogLevel reverts to the configured log level
+func (s *server) restoreLogLevel(c echo.Context) error {
+	s.levels.restore()
+	return c.JSON(http.StatusOK, s.levels.status())
+}
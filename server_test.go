@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/byuoitav/mute-service/state"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testServer returns an api server managing ITB-1108A, which is loaded from a fake
+// av-api, and ITB-1101, which hasn't been loaded
+func testServer(t *testing.T) (*server, *avapitest.Server) {
+	avapi := avapitest.NewServer(avapitest.Room{
+		Displays: []avapitest.Display{{Name: "D1"}, {Name: "D2"}},
+		AudioDevices: []avapitest.AudioDevice{
+			{Name: "D1", Power: "on", Input: "VIA1"},
+			{Name: "D2", Power: "on", Input: "VIA1"},
+		},
+	})
+	t.Cleanup(avapi.Close)
+
+	manager := func(roomID string) *state.RoomStateManager {
+		return &state.RoomStateManager{
+			Log:                zap.NewNop(),
+			RoomID:             roomID,
+			AvApiAddress:       avapi.Address(),
+			AudioPriorityCache: make(map[string]string),
+		}
+	}
+
+	s := &server{
+		log: zap.NewNop(),
+		rooms: roomManagers{
+			"ITB-1108A": manager("ITB-1108A"),
+			"ITB-1101":  manager("ITB-1101"),
+		},
+	}
+	assert.Nil(t, s.rooms["ITB-1108A"].InitializeRoomState())
+
+	return s, avapi
+}
+
+func request(s *server, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestLockDisplayHandler(t *testing.T) {
+	s, avapi := testServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"unknown room", http.MethodPut, "/rooms/ITB-9999/displays/D1/lock/muted", http.StatusNotFound},
+		{"bad state", http.MethodPut, "/rooms/ITB-1108A/displays/D1/lock/loud", http.StatusBadRequest},
+		{"bad duration", http.MethodPut, "/rooms/ITB-1108A/displays/D1/lock/muted?for=-5m", http.StatusBadRequest},
+		{"room not loaded", http.MethodPut, "/rooms/ITB-1101/displays/D1/lock/muted", http.StatusServiceUnavailable},
+		{"unknown display", http.MethodPut, "/rooms/ITB-1108A/displays/D9/lock/muted", http.StatusNotFound},
+		{"locked", http.MethodPut, "/rooms/ITB-1108A/displays/D1/lock/muted?for=1h", http.StatusOK},
+		{"unlocked", http.MethodDelete, "/rooms/ITB-1108A/displays/D1/lock", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(s, tt.method, tt.path)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+		})
+	}
+
+	rec := request(s, http.MethodPut, "/rooms/ITB-1108A/displays/D2/lock/unmuted")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var locks []state.Lock
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &locks))
+	assert.Equal(t, []state.Lock{{Display: "D2"}}, locks)
+	assert.Equal(t, false, avapi.Room().AudioDevices[1].Muted)
+
+	// the lock is kept even though the av-api can't apply it
+	avapi.SetStatus(http.StatusBadGateway)
+	rec = request(s, http.MethodPut, "/rooms/ITB-1108A/displays/D1/lock/unmuted")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, 2, len(s.rooms["ITB-1108A"].Locks()))
+}
+
+func TestSetWinnerHandler(t *testing.T) {
+	s, avapi := testServer(t)
+
+	assert.Equal(t, http.StatusNotFound, request(s, http.MethodPut, "/rooms/ITB-9999/inputs/VIA1/winner/D2").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, request(s, http.MethodPut, "/rooms/ITB-1101/inputs/VIA1/winner/D2").Code)
+	assert.Equal(t, http.StatusNotFound, request(s, http.MethodPut, "/rooms/ITB-1108A/inputs/VIA1/winner/D9").Code)
+
+	assert.Equal(t, http.StatusOK, request(s, http.MethodPut, "/rooms/ITB-1108A/inputs/VIA1/winner/D2").Code)
+	room := avapi.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+
+	// a display that wouldn't win is refused
+	assert.Equal(t, http.StatusConflict, request(s, http.MethodPut, "/rooms/ITB-1108A/inputs/PC1/winner/D1").Code)
+	assert.Equal(t, http.StatusOK, request(s, http.MethodPut, "/rooms/ITB-1108A/displays/D1/lock/muted").Code)
+	assert.Equal(t, http.StatusConflict, request(s, http.MethodPut, "/rooms/ITB-1108A/inputs/VIA1/winner/D1").Code)
+	assert.Equal(t, http.StatusOK, request(s, http.MethodDelete, "/rooms/ITB-1108A/locks").Code)
+
+	avapi.SetStatus(http.StatusBadGateway)
+	assert.Equal(t, http.StatusBadGateway, request(s, http.MethodPut, "/rooms/ITB-1108A/inputs/VIA1/winner/D1").Code)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/hub"
+	"github.com/byuoitav/mute-service/roomconfig"
+	"github.com/byuoitav/mute-service/state"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/spf13/pflag"
+)
+
+const simulateHelp = `commands:
+  power <display> on|standby   power a display on or off
+  input <display> <input>      switch a display's input
+  mute <display> true|false    mute or unmute a display
+  master mute|unmute|set       press a master volume button on the display page
+  hub down|up                  drop or restore the connection to the event hub
+  state                        print the room as the av-api sees it
+  wait <duration>              wait, e.g. for displays to warm up
+  help                         print this help
+  quit                         exit the simulator`
+
+// simulate runs the service against a fake av-api and a fake event hub, driven by
+// commands typed by an operator or read from a script
+func simulate(args []string) error {
+	return runSimulation(args, os.Stdin, os.Stdout)
+}
+
+// runSimulation runs the simulator, reading commands from stdin unless a script is
+// given and writing everything it prints to out
+func runSimulation(args []string, stdin io.Reader, out io.Writer) error {
+	var (
+		logLevel string
+		roomID   string
+		displays []string
+		script   string
+		policy   string
+		roomFile string
+		warmup   time.Duration
+		cooldown time.Duration
+	)
+
+	flags := pflag.NewFlagSet("simulate", pflag.ContinueOnError)
+	flags.StringVarP(&logLevel, "log-level", "L", "warn", "Level at which the logger operates")
+	flags.StringVarP(&roomID, "room", "r", "ITB-1101", "Room id to simulate")
+	flags.StringSliceVarP(&displays, "displays", "d", []string{"D1", "D2", "D3"}, "Displays in the room, optionally with their starting input, e.g. D1:PC1")
+	flags.StringVarP(&script, "script", "s", "", "File of commands to run instead of reading from stdin")
+	flags.StringVarP(&policy, "policy", "", string(state.PolicySticky), "How the audio display is chosen for an input shown on several displays: sticky or lowest-display-number")
+	flags.StringVarP(&roomFile, "room-config", "", "", "YAML or JSON file of room configuration, e.g. for excluded displays and audio displays")
+	flags.DurationVarP(&warmup, "warmup", "", 3*time.Second, "How long to wait after a display powers on before resolving the room")
+	flags.DurationVarP(&cooldown, "cooldown", "", 10*time.Second, "How long to wait after every display is in standby before forgetting the room's audio preferences")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !state.Policy(policy).Valid() {
+		return fmt.Errorf("invalid policy %q, use sticky or lowest-display-number", policy)
+	}
+
+	_, log := logger(logLevel)
+	defer log.Sync()
+
+	room := avapitest.Room{}
+	for _, d := range displays {
+		name, input := d, "HDMI1"
+		if i := strings.Index(d, ":"); i >= 0 {
+			name, input = d[:i], d[i+1:]
+		}
+
+		room.Displays = append(room.Displays, avapitest.Display{Name: name})
+		room.AudioDevices = append(room.AudioDevices, avapitest.AudioDevice{Name: name, Power: "on", Input: input})
+	}
+
+	avapi := avapitest.NewServer(room)
+	defer avapi.Close()
+
+	fakeHub := hub.NewMemory(100)
+	fakeHub.SubscribeToRooms(roomID)
+
+	// like the real av-api, report the mutes it was told to make back to the hub
+	avapi.OnPut = func(path string, body []byte) {
+		fmt.Fprintf(out, "av-api <- PUT %s %s\n", path, body)
+
+		var update avapitest.Room
+		json.Unmarshal(body, &update)
+		for _, ad := range update.AudioDevices {
+			fakeHub.SendEvent(newSimulatedEvent(roomID, ad.Name, "muted", fmt.Sprint(ad.Muted)))
+		}
+	}
+
+	manager := &state.RoomStateManager{
+		Log:                log,
+		RoomID:             roomID,
+		AvApiAddress:       avapi.Address(),
+		AudioPriorityCache: make(map[string]string),
+		WarmupPeriod:       warmup,
+		CooldownPeriod:     cooldown,
+		Policy:             state.Policy(policy),
+		Recorder:           decisionPrinter{out: out},
+	}
+
+	if roomFile != "" {
+		manager.RoomConfig = &roomconfig.File{Path: roomFile}
+	}
+
+	if err := manager.InitializeRoomState(); err != nil {
+		return fmt.Errorf("unable to initialize room: %w", err)
+	}
+
+	managers := roomManagers{roomID: manager}
+	go listen(fakeHub, managers, nil, log)
+	go watchConnection(fakeHub, managers, &readiness{}, log)
+
+	// like the real devices, change and then report the change to the hub,
+	// unless the service's connection to the hub is down
+	hubUp := true
+	send := func(event events.Event) {
+		avapi.Apply(event)
+		if hubUp {
+			fakeHub.SendEvent(event)
+		}
+	}
+
+	in := stdin
+	if script != "" {
+		f, err := os.Open(script)
+		if err != nil {
+			return fmt.Errorf("unable to open script: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	fmt.Fprintf(out, "simulating %s with fake av-api at %s\n%s\n", roomID, avapi.URL, simulateHelp)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if script == "" {
+			fmt.Fprint(out, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if script != "" {
+			fmt.Fprintf(out, "> %s\n", strings.Join(fields, " "))
+		}
+
+		switch {
+		case fields[0] == "quit" || fields[0] == "exit":
+			return nil
+		case fields[0] == "help":
+			fmt.Fprintln(out, simulateHelp)
+		case fields[0] == "hub" && len(fields) == 2:
+			switch {
+			case fields[1] == "down" && hubUp:
+				hubUp = false
+				fakeHub.Disconnect()
+			case fields[1] == "up" && !hubUp:
+				hubUp = true
+				fakeHub.Reconnect()
+			}
+		case fields[0] == "state":
+			b, _ := json.MarshalIndent(avapi.Room(), "", "  ")
+			fmt.Fprintln(out, string(b))
+		case fields[0] == "wait" && len(fields) == 2:
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				fmt.Fprintf(out, "invalid duration: %s\n", err)
+				continue
+			}
+			time.Sleep(d)
+		case fields[0] == "power" && len(fields) == 3:
+			send(newSimulatedEvent(roomID, fields[1], "power", fields[2]))
+		case fields[0] == "input" && len(fields) == 3:
+			send(newSimulatedEvent(roomID, fields[1], "input", fields[2]))
+		case fields[0] == "mute" && len(fields) == 3:
+			send(newSimulatedEvent(roomID, fields[1], "muted", fields[2]))
+		case fields[0] == "master" && len(fields) == 2:
+			event := newSimulatedEvent(roomID, "CP1", "user-interaction", "")
+			switch fields[1] {
+			case "mute":
+				event.Value = "master volume mute on display page"
+			case "unmute":
+				event.Value = "master volume unmute on display page"
+			case "set":
+				event.Value = "master volume set on display page"
+			default:
+				fmt.Fprintln(out, "master must be one of mute, unmute or set")
+				continue
+			}
+			send(event)
+		default:
+			fmt.Fprintf(out, "unknown command: %s\n", strings.Join(fields, " "))
+		}
+
+		// give the service a moment to react before the next command
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return scanner.Err()
+}
+
+func newSimulatedEvent(roomID, display, key, value string) events.Event {
+	bldg := strings.Split(roomID, "-")[0]
+	return events.Event{
+		GeneratingSystem: roomID + "-CP1",
+		Timestamp:        time.Now(),
+		TargetDevice: events.BasicDeviceInfo{
+			BasicRoomInfo: events.BasicRoomInfo{
+				BuildingID: bldg,
+				RoomID:     roomID,
+			},
+			DeviceID: roomID + "-" + display,
+		},
+		AffectedRoom: events.BasicRoomInfo{
+			BuildingID: bldg,
+			RoomID:     roomID,
+		},
+		Key:   key,
+		Value: value,
+	}
+}
+
+// decisionPrinter prints a summary of every decision made by the simulated service
+type decisionPrinter struct {
+	out io.Writer
+}
+
+func (p decisionPrinter) RecordDecision(d state.Decision) {
+	fmt.Fprintf(p.out, "service: %s (power %s)", d.Reason, d.Power)
+	for input, w := range d.Winners {
+		fmt.Fprintf(p.out, " %s=%s[%s]", input, w.Display, w.Rule)
+	}
+	if d.Error != "" {
+		fmt.Fprintf(p.out, " error: %s", d.Error)
+	}
+	fmt.Fprintln(p.out)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that the simulator's goroutines can write to at once
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestSimulateScript(t *testing.T) {
+	script := writeFile(t, "script.txt", `# D1 joins D2 on VIA1, and D2 keeps the audio it already had
+input D1 VIA1
+
+# D2 is muted by hand while the service can't hear it, which the resync on reconnect undoes
+hub down
+mute D2 true
+hub up
+
+dance D1
+wait soon
+state
+quit
+input D2 PC1
+`)
+
+	var out syncBuffer
+	err := runSimulation([]string{"--script", script, "--displays", "D1:PC1,D2:VIA1", "--warmup", "0", "--cooldown", "0"}, nil, &out)
+	assert.Nil(t, err)
+
+	output := out.String()
+	assert.Contains(t, output, "unknown command: dance D1")
+	assert.Contains(t, output, "invalid duration")
+	assert.Contains(t, output, "service: resync")
+	assert.NotContains(t, output, "> input D2 PC1", "commands after quit aren't run")
+
+	room := printedState(t, output)
+	if assert.Equal(t, 2, len(room.AudioDevices)) {
+		assert.Equal(t, "VIA1", room.AudioDevices[0].Input)
+		assert.Equal(t, true, room.AudioDevices[0].Muted)
+		assert.Equal(t, false, room.AudioDevices[1].Muted, "the resync should give the audio back to D2")
+	}
+
+	// with the lowest display number policy D1 takes the audio from D2, and D3 is left
+	// alone since the room configuration excludes it
+	roomConfig := writeFile(t, "rooms.yaml", "rooms:\n  ITB-1101:\n    excluded: [D3]\n")
+	script = writeFile(t, "script.txt", "input D1 VIA1\nstate\n")
+
+	out = syncBuffer{}
+	err = runSimulation([]string{"--script", script, "--displays", "D1:PC1,D2:VIA1,D3:VIA1", "--warmup", "0", "--cooldown", "0",
+		"--policy", "lowest-display-number", "--room-config", roomConfig}, nil, &out)
+	assert.Nil(t, err)
+
+	room = printedState(t, out.String())
+	if assert.Equal(t, 3, len(room.AudioDevices)) {
+		assert.Equal(t, false, room.AudioDevices[0].Muted)
+		assert.Equal(t, true, room.AudioDevices[1].Muted)
+		assert.Equal(t, false, room.AudioDevices[2].Muted, "excluded displays are never muted")
+	}
+
+	assert.NotNil(t, runSimulation([]string{"--script", script, "--policy", "loudest"}, nil, &syncBuffer{}))
+}
+
+// printedState returns the room as printed by the last state command in output
+func printedState(t *testing.T, output string) avapitest.Room {
+	var room avapitest.Room
+
+	i := strings.LastIndex(output, "> state\n")
+	if !assert.True(t, i >= 0, "no state was printed") {
+		return room
+	}
+
+	assert.Nil(t, json.NewDecoder(strings.NewReader(output[i+len("> state\n"):])).Decode(&room))
+	return room
+}
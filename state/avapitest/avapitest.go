@@ -0,0 +1,265 @@
+// Package avapitest provides a fake av-api for testing code that talks to the
+// room endpoints of the av-api.
+package avapitest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// Room is a room as the av-api reports it
+type Room struct {
+	Displays     []Display     `json:"displays"`
+	AudioDevices []AudioDevice `json:"audioDevices"`
+}
+
+// Display is a display in a Room
+type Display struct {
+	Name string `json:"name"`
+}
+
+// AudioDevice is an audio device in a Room
+type AudioDevice struct {
+	Name  string `json:"name"`
+	Muted bool   `json:"muted"`
+	Power string `json:"power"`
+	Input string `json:"input"`
+}
+
+// Request is a request made to the Server
+type Request struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Body   []byte
+	// Status is the status code the Server responded with, or zero if the connection was dropped
+	Status int
+}
+
+// Server is a fake av-api serving GET and PUT on /buildings/{building}/rooms/{room}.
+// Every room path serves the same Room. Mutes sent in a PUT are applied to the Room.
+type Server struct {
+	*httptest.Server
+
+	// OnPut, if set, is called with the path and body of every successful PUT
+	OnPut func(path string, body []byte)
+
+	mu       sync.Mutex
+	room     Room
+	changed  map[string]time.Time
+	requests []Request
+	latency  time.Duration
+	status   int
+	drop     bool
+}
+
+// NewServer starts a Server serving room
+func NewServer(room Room) *Server {
+	s := &Server{
+		room:    room,
+		changed: make(map[string]time.Time),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Address is the host:port of the Server, as given to --av-api
+func (s *Server) Address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Room returns a copy of the current state of the room
+func (s *Server) Room() Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.copyRoom()
+}
+
+func (s *Server) copyRoom() Room {
+	return Room{
+		Displays:     append([]Display{}, s.room.Displays...),
+		AudioDevices: append([]AudioDevice{}, s.room.AudioDevices...),
+	}
+}
+
+// SetRoom replaces the state of the room
+func (s *Server) SetRoom(room Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.room = room
+}
+
+// Requests returns every request made to the Server, in order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request{}, s.requests...)
+}
+
+// Puts returns every PUT made to the Server, in order
+func (s *Server) Puts() []Request {
+	var puts []Request
+	for _, r := range s.Requests() {
+		if r.Method == http.MethodPut {
+			puts = append(puts, r)
+		}
+	}
+	return puts
+}
+
+// SetLatency delays every response by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// SetStatus makes every request fail with status. Zero goes back to serving normally.
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = status
+}
+
+// SetDropConnections makes every request fail by closing the connection without a response
+func (s *Server) SetDropConnections(drop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drop = drop
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	latency, status, drop := s.latency, s.status, s.drop
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+
+	req := Request{
+		Time:   time.Now(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Body:   body,
+	}
+
+	defer func() {
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+	}()
+
+	switch {
+	case drop:
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		req.Status = http.StatusServiceUnavailable
+		w.WriteHeader(req.Status)
+		return
+	case status != 0:
+		req.Status = status
+		http.Error(w, "injected failure", status)
+		return
+	case !strings.HasPrefix(r.URL.Path, "/buildings/") || !strings.Contains(r.URL.Path, "/rooms/"):
+		req.Status = http.StatusNotFound
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Status = http.StatusOK
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Room())
+	case http.MethodPut:
+		var update Room
+		if err := json.Unmarshal(body, &update); err != nil {
+			req.Status = http.StatusBadRequest
+			http.Error(w, err.Error(), req.Status)
+			return
+		}
+
+		s.mu.Lock()
+		for _, ad := range update.AudioDevices {
+			if d := s.device(ad.Name); d != nil {
+				d.Muted = ad.Muted
+			}
+		}
+		room := s.copyRoom()
+		s.mu.Unlock()
+
+		if s.OnPut != nil {
+			s.OnPut(r.URL.Path, body)
+		}
+
+		req.Status = http.StatusOK
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	default:
+		req.Status = http.StatusMethodNotAllowed
+		w.WriteHeader(req.Status)
+	}
+}
+
+// Apply updates the device an event is about, the way the real device would have changed.
+// Events older than the last change to the same device and field are ignored.
+func (s *Server) Apply(event events.Event) {
+	tokens := strings.Split(event.TargetDevice.DeviceID, "-")
+	if len(tokens) < 3 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.device(tokens[2])
+	if d == nil {
+		return
+	}
+
+	key := d.Name + "/" + event.Key
+	if event.Timestamp.Before(s.changed[key]) {
+		return
+	}
+	s.changed[key] = event.Timestamp
+
+	switch event.Key {
+	case "power":
+		d.Power = event.Value
+	case "input":
+		d.Input = event.Value
+	case "muted":
+		if muted, err := strconv.ParseBool(event.Value); err == nil {
+			d.Muted = muted
+		}
+	}
+}
+
+func (s *Server) device(name string) *AudioDevice {
+	for i := range s.room.AudioDevices {
+		if s.room.AudioDevices[i].Name == name {
+			return &s.room.AudioDevices[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"net/http"
+
+	"github.com/byuoitav/mute-service/client"
+	"go.uber.org/zap"
+)
+
+// Backend reads and controls the devices in a room
+type Backend interface {
+	// RoomState returns the current state of the room's displays
+	RoomState(roomID string) (*AVState, error)
+	// UpdateRoomState applies the mute state of every audio device in state
+	UpdateRoomState(roomID string, state *AVState) error
+}
+
+// AVAPI is a Backend that controls rooms through the av-api
+type AVAPI struct {
+	// Address is the host:port of the av-api, optionally with an http or https scheme
+	Address string
+	// Client is used for requests to the av-api. Defaults to http.DefaultClient.
+	Client *http.Client
+	Log    *zap.Logger
+}
+
+func (a *AVAPI) roomURL(roomID string) (string, error) {
+	a.Log.Debug("parsing room id")
+	bldg, room, err := parseRoomID(roomID)
+	if err != nil {
+		a.Log.Error("failed to parse room id", zap.Error(err))
+		return "", err
+	}
+
+	return client.URL(a.Address) + "/buildings/" + bldg + "/rooms/" + room, nil
+}
+
+func (a *AVAPI) client() *http.Client {
+	if a.Client == nil {
+		return http.DefaultClient
+	}
+	return a.Client
+}
+
+// RoomState implements Backend
+func (a *AVAPI) RoomState(roomID string) (*AVState, error) {
+	url, err := a.roomURL(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	return requestAVState(a.client(), url, a.Log)
+}
+
+// UpdateRoomState implements Backend
+func (a *AVAPI) UpdateRoomState(roomID string, state *AVState) error {
+	url, err := a.roomURL(roomID)
+	if err != nil {
+		return err
+	}
+
+	return updateAVState(a.client(), url, state, a.Log)
+}
+
+// backend returns the manager's Backend, defaulting to the av-api at AvApiAddress
+func (rm *RoomStateManager) backend() Backend {
+	if rm.Backend == nil {
+		rm.Backend = &AVAPI{
+			Address: rm.AvApiAddress,
+			Log:     rm.Log,
+		}
+	}
+
+	return rm.Backend
+}
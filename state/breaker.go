@@ -0,0 +1,214 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is returned for updates that were queued because the backend is failing
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker is a Backend that stops sending updates to a failing backend instead of
+// hammering it. Each room has its own breaker, so one room whose displays keep failing
+// doesn't hold back the others. The latest desired state of a room is kept while its
+// updates are failing and applied once they succeed again, so rooms aren't left half-muted.
+type Breaker struct {
+	Backend Backend
+
+	// Failures is how many updates in a row to a room must fail before its breaker opens. Defaults to 3.
+	Failures int
+
+	// Cooldown is how long to wait before retrying a failed update. It doubles after
+	// each failed retry while the room's breaker is open, up to MaxCooldown. Default to 5s and 2m.
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+
+	Log *zap.Logger
+
+	mu    sync.Mutex
+	rooms map[string]*roomBreaker
+}
+
+// roomBreaker is the breaker state of a single room
+type roomBreaker struct {
+	// log carries the room, so the breaker's logs for it don't have to
+	log *zap.Logger
+
+	// send is held while an update is sent, so a retried state can't land after a newer one
+	send sync.Mutex
+
+	failures int
+	open     bool
+	wait     time.Duration
+	retry    *time.Timer
+	desired  *AVState
+	applied  *AVState
+}
+
+// RoomState implements Backend. Reads are always passed through.
+func (b *Breaker) RoomState(roomID string) (*AVState, error) {
+	return b.Backend.RoomState(roomID)
+}
+
+// UpdateRoomState implements Backend. While the room's breaker is open, state is kept as
+// the room's desired state and ErrCircuitOpen is returned.
+func (b *Breaker) UpdateRoomState(roomID string, state *AVState) error {
+	b.mu.Lock()
+	r := b.room(roomID)
+	if r.open {
+		r.desired = state
+		b.mu.Unlock()
+		return fmt.Errorf("%w: update queued until the backend recovers", ErrCircuitOpen)
+	}
+	b.mu.Unlock()
+
+	r.send.Lock()
+	defer r.send.Unlock()
+
+	err := b.Backend.UpdateRoomState(roomID, state)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		r.desired = state
+		b.failed(roomID, r, err)
+		return err
+	}
+
+	b.succeeded(r, state)
+	r.desired = nil
+	return nil
+}
+
+// Open returns true while updates to a room are being queued instead of sent
+func (b *Breaker) Open(roomID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.room(roomID).open
+}
+
+// Desired returns the state waiting to be applied to a room, or nil if there isn't one
+func (b *Breaker) Desired(roomID string) *AVState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.room(roomID).desired
+}
+
+// Applied returns the state last successfully applied to a room, or nil if there isn't one
+func (b *Breaker) Applied(roomID string) *AVState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.room(roomID).applied
+}
+
+func (b *Breaker) room(roomID string) *roomBreaker {
+	if b.rooms == nil {
+		b.rooms = make(map[string]*roomBreaker)
+	}
+
+	r, ok := b.rooms[roomID]
+	if !ok {
+		r = &roomBreaker{log: b.Log.With(zap.String("room", roomID))}
+		b.rooms[roomID] = r
+	}
+
+	return r
+}
+
+func (b *Breaker) succeeded(r *roomBreaker, state *AVState) {
+	if r.open {
+		r.log.Info("backend recovered, closing circuit breaker")
+	}
+
+	r.open = false
+	r.failures = 0
+	r.wait = 0
+	r.applied = state
+}
+
+// failed counts a failed update to a room, opening its breaker once enough have failed
+// in a row, and schedules a retry of its desired state
+func (b *Breaker) failed(roomID string, r *roomBreaker, err error) {
+	r.failures++
+
+	threshold := b.Failures
+	if threshold <= 0 {
+		threshold = 3
+	}
+
+	if !r.open && r.failures >= threshold {
+		r.log.Warn("backend is failing, opening circuit breaker", zap.Int("failures", r.failures), zap.Error(err))
+		r.open = true
+	}
+
+	if r.retry != nil {
+		return
+	}
+
+	switch {
+	case r.wait == 0:
+		r.wait = b.Cooldown
+		if r.wait <= 0 {
+			r.wait = 5 * time.Second
+		}
+	case r.open:
+		max := b.MaxCooldown
+		if max <= 0 {
+			max = 2 * time.Minute
+		}
+
+		if r.wait *= 2; r.wait > max {
+			r.wait = max
+		}
+	}
+
+	r.log.Debug("retrying desired room state", zap.Duration("in", r.wait))
+	r.retry = time.AfterFunc(r.wait, func() { b.flush(roomID) })
+}
+
+// flush tries to apply the desired state of a room
+func (b *Breaker) flush(roomID string) {
+	b.mu.Lock()
+	r := b.room(roomID)
+	b.mu.Unlock()
+
+	r.send.Lock()
+	defer r.send.Unlock()
+
+	b.mu.Lock()
+	r.retry = nil
+	state := r.desired
+	b.mu.Unlock()
+
+	// a newer state was applied while waiting to send
+	if state == nil {
+		return
+	}
+
+	err := b.Backend.UpdateRoomState(roomID, state)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		b.failed(roomID, r, err)
+		return
+	}
+
+	b.succeeded(r, state)
+
+	// a newer state may have been queued while this one was being sent
+	if r.desired == state {
+		r.desired = nil
+	} else if r.desired != nil && r.retry == nil {
+		r.retry = time.AfterFunc(0, func() { b.flush(roomID) })
+	}
+}
@@ -0,0 +1,172 @@
+package state
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBreaker(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	breaker := &Breaker{
+		Backend: &AVAPI{
+			Address: server.Address(),
+			Log:     zap.NewExample(),
+		},
+		Failures: 2,
+		Cooldown: 50 * time.Millisecond,
+		Log:      zap.NewExample(),
+	}
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AudioPriorityCache: make(map[string]string),
+		Backend:            breaker,
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.NotNil(t, breaker.Applied("ITB-1108A"))
+	assert.Nil(t, breaker.Desired("ITB-1108A"))
+
+	server.SetStatus(http.StatusBadGateway)
+	assert.NotNil(t, manager.ResolveRoom())
+	assert.Equal(t, false, breaker.Open("ITB-1108A"), "a single failure shouldn't open the breaker")
+	assert.NotNil(t, manager.ResolveRoom())
+	assert.Equal(t, true, breaker.Open("ITB-1108A"))
+
+	// updates are queued rather than sent while the breaker is open
+	puts := len(server.Puts())
+	manager.AudioPriorityCache["VIA1"] = "D2"
+	err := manager.ResolveRoom()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, puts, len(server.Puts()))
+	assert.Equal(t, true, breaker.Desired("ITB-1108A").AudioDevices[0].Muted)
+
+	// the latest desired state is applied once the av-api recovers
+	server.SetStatus(0)
+	assert.Eventually(t, func() bool {
+		return !breaker.Open("ITB-1108A")
+	}, time.Second, 10*time.Millisecond)
+
+	room := server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+	assert.Nil(t, breaker.Desired("ITB-1108A"))
+	assert.Equal(t, true, breaker.Applied("ITB-1108A").AudioDevices[0].Muted)
+
+	assert.Nil(t, manager.ResolveRoom())
+}
+
+// roomBackends sends each room to its own backend
+type roomBackends map[string]Backend
+
+func (r roomBackends) RoomState(roomID string) (*AVState, error) {
+	return r[roomID].RoomState(roomID)
+}
+
+func (r roomBackends) UpdateRoomState(roomID string, state *AVState) error {
+	return r[roomID].UpdateRoomState(roomID, state)
+}
+
+func TestBreakerRooms(t *testing.T) {
+	failing := avapitest.NewServer(testRoom())
+	defer failing.Close()
+	healthy := avapitest.NewServer(testRoom())
+	defer healthy.Close()
+
+	breaker := &Breaker{
+		Backend: roomBackends{
+			"ITB-1108A": &AVAPI{Address: failing.Address(), Log: zap.NewExample()},
+			"ITB-1101":  &AVAPI{Address: healthy.Address(), Log: zap.NewExample()},
+		},
+		Failures: 2,
+		Cooldown: time.Hour,
+		Log:      zap.NewExample(),
+	}
+
+	state, err := breaker.RoomState("ITB-1101")
+	assert.Nil(t, err)
+
+	failing.SetStatus(http.StatusBadGateway)
+	assert.NotNil(t, breaker.UpdateRoomState("ITB-1108A", state))
+	assert.Nil(t, breaker.UpdateRoomState("ITB-1101", state))
+	assert.NotNil(t, breaker.UpdateRoomState("ITB-1108A", state))
+
+	// a success in another room doesn't reset the failing room's count, and the failing
+	// room's breaker doesn't hold back the healthy room
+	assert.Equal(t, true, breaker.Open("ITB-1108A"))
+	assert.Equal(t, false, breaker.Open("ITB-1101"))
+	assert.Nil(t, breaker.UpdateRoomState("ITB-1101", state))
+	assert.Equal(t, 2, len(healthy.Puts()))
+	assert.Nil(t, breaker.Desired("ITB-1101"))
+	assert.NotNil(t, breaker.Desired("ITB-1108A"))
+}
+
+// funcBackend sends updates to a function
+type funcBackend func(roomID string, state *AVState) error
+
+func (f funcBackend) RoomState(roomID string) (*AVState, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f funcBackend) UpdateRoomState(roomID string, state *AVState) error {
+	return f(roomID, state)
+}
+
+func TestBreakerOrdering(t *testing.T) {
+	older, newer := &AVState{}, &AVState{}
+
+	var mu sync.Mutex
+	var calls int
+	var last *AVState
+
+	breaker := &Breaker{
+		Backend: funcBackend(func(roomID string, state *AVState) error {
+			mu.Lock()
+			calls++
+			first := calls == 1
+			mu.Unlock()
+
+			if first {
+				return errors.New("av-api unavailable")
+			}
+
+			// the retry of the older state is slower than the newer update, so it would
+			// land second if both were sent at once
+			if state == older {
+				time.Sleep(60 * time.Millisecond)
+			} else {
+				time.Sleep(30 * time.Millisecond)
+			}
+
+			mu.Lock()
+			last = state
+			mu.Unlock()
+			return nil
+		}),
+		Cooldown: 10 * time.Millisecond,
+		Log:      zap.NewExample(),
+	}
+
+	assert.NotNil(t, breaker.UpdateRoomState("ITB-1108A", older))
+	assert.Equal(t, false, breaker.Open("ITB-1108A"))
+	assert.Nil(t, breaker.UpdateRoomState("ITB-1108A", newer))
+
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Same(t, newer, last, "the queued older state must not be applied after the newer one")
+	assert.Equal(t, 2, calls)
+	assert.Same(t, newer, breaker.Applied("ITB-1108A"))
+	assert.Nil(t, breaker.Desired("ITB-1108A"))
+}
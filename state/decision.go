@@ -0,0 +1,128 @@
+package state
+
+import (
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+// Policy is how the audio display for an input is chosen when several displays share it
+type Policy string
+
+const (
+	// PolicySticky keeps the display that last had the audio for an input, falling back to the lowest display number
+	PolicySticky Policy = "sticky"
+	// PolicyLowestNumber always chooses the lowest display number, even if another display already had the audio
+	PolicyLowestNumber Policy = "lowest-display-number"
+)
+
+// Valid returns true if p is a known policy. The empty policy is PolicySticky.
+func (p Policy) Valid() bool {
+	switch p {
+	case "", PolicySticky, PolicyLowestNumber:
+		return true
+	default:
+		return false
+	}
+}
+
+// Rule is the reason a display was chosen to play the audio for its input
+type Rule string
+
+const (
+	// RuleOnlyDisplay means the display is the only one on its input
+	RuleOnlyDisplay Rule = "only-display"
+	// RulePriorityCache means the display already had the audio for its input
+	RulePriorityCache Rule = "priority-cache"
+	// RuleLowestNumber means the display has the lowest display number on its input
+	RuleLowestNumber Rule = "lowest-display-number"
+	// RuleOverride means the display is locked unmuted, or that every display on the input is locked muted
+	RuleOverride Rule = "override"
+	// RuleConfig means the room configuration says the display plays the audio for its input
+	RuleConfig Rule = "config"
+)
+
+// Winner is the display chosen to play the audio for an input
+type Winner struct {
+	Display string `json:"display"`
+	Rule    Rule   `json:"rule"`
+}
+
+// DeviceState is a full snapshot of an audio device, unlike AudioDevice which
+// only marshals the fields sent to the av-api
+type DeviceState struct {
+	Name  string `json:"name"`
+	Muted bool   `json:"muted"`
+	Power string `json:"power"`
+	Input string `json:"input"`
+}
+
+// Decision records a single resolution of the room: what triggered it, how the
+// displays were grouped, who won each input, and whether the av-api accepted it
+type Decision struct {
+	Time        time.Time           `json:"time"`
+	Room        string              `json:"room"`
+	Reason      string              `json:"reason"`
+	Trigger     *events.Event       `json:"trigger,omitempty"`
+	Power       PowerState          `json:"power"`
+	MasterMuted bool                `json:"masterMuted"`
+	Before      []DeviceState       `json:"before"`
+	Groups      map[string][]string `json:"groups,omitempty"`
+	Policy      Policy              `json:"policy"`
+	Winners     map[string]Winner   `json:"winners,omitempty"`
+	After       []DeviceState       `json:"after"`
+	Applied     bool                `json:"applied"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// DecisionRecorder stores decisions made by a RoomStateManager
+type DecisionRecorder interface {
+	RecordDecision(Decision)
+}
+
+func snapshot(state *AVState) []DeviceState {
+	devices := make([]DeviceState, 0, len(state.AudioDevices))
+	for _, ad := range state.AudioDevices {
+		devices = append(devices, DeviceState{
+			Name:  ad.Name,
+			Muted: ad.Muted,
+			Power: ad.Power,
+			Input: ad.Input,
+		})
+	}
+	return devices
+}
+
+// newDecision starts a decision from the current state of the room
+func (rm *RoomStateManager) newDecision(reason string) *Decision {
+	policy := rm.Policy
+	if policy == "" {
+		policy = PolicySticky
+	}
+
+	return &Decision{
+		Time:        time.Now(),
+		Room:        rm.RoomID,
+		Reason:      reason,
+		Trigger:     rm.trigger,
+		Power:       rm.power,
+		MasterMuted: rm.MasterMuted,
+		Before:      snapshot(rm.RoomState),
+		Policy:      policy,
+	}
+}
+
+// recordDecision finishes the decision with the room's new state and the outcome of applying it
+func (rm *RoomStateManager) recordDecision(d *Decision, err error) {
+	if rm.Recorder == nil {
+		return
+	}
+
+	d.After = snapshot(rm.RoomState)
+	d.Applied = err == nil
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	rm.Recorder.RecordDecision(*d)
+}
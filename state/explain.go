@@ -0,0 +1,162 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotLoaded is returned when the room hasn't been loaded from the backend yet
+var ErrNotLoaded = errors.New("room hasn't been loaded yet")
+
+// GroupExplanation is which display plays the audio for an input, and why
+type GroupExplanation struct {
+	Input    string   `json:"input"`
+	Displays []string `json:"displays"`
+	Winner   Winner   `json:"winner"`
+	Reason   string   `json:"reason"`
+	// Muted is the displays in the group that are currently muted
+	Muted []string `json:"muted"`
+}
+
+// Explanation is the audio layout of a room and the reasons for it
+type Explanation struct {
+	Room        string             `json:"room"`
+	Power       PowerState         `json:"power"`
+	Policy      Policy             `json:"policy"`
+	MasterMuted bool               `json:"masterMuted"`
+	Groups      []GroupExplanation `json:"groups"`
+	// Standby is the displays that are powered off, which are left alone
+	Standby []string `json:"standby"`
+	// Excluded is the displays the room configuration says are never touched
+	Excluded []string `json:"excluded"`
+	Locks    []Lock   `json:"locks"`
+}
+
+// Explain returns the room's audio layout: its displays grouped by input, which
+// display in each group plays the audio, and the rule that chose it
+func (rm *RoomStateManager) Explain() (Explanation, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.RoomState == nil {
+		return Explanation{}, ErrNotLoaded
+	}
+
+	policy := rm.Policy
+	if policy == "" {
+		policy = PolicySticky
+	}
+
+	e := Explanation{
+		Room:        rm.RoomID,
+		Power:       rm.power,
+		Policy:      policy,
+		MasterMuted: rm.MasterMuted,
+		Groups:      []GroupExplanation{},
+		Standby:     []string{},
+		Excluded:    append([]string{}, rm.config.Excluded...),
+		Locks:       rm.lockList(),
+	}
+
+	for input, displays := range groupDisplays(rm.RoomState) {
+		g := GroupExplanation{
+			Input:    input,
+			Displays: displays,
+			Winner:   chooseWinner(rm.choice(input, displays)),
+			Muted:    []string{},
+		}
+		g.Reason = g.Winner.Rule.describe(g.Winner.Display, input)
+
+		for _, name := range displays {
+			if d := rm.findDisplay(name); d != nil && d.Muted {
+				g.Muted = append(g.Muted, name)
+			}
+		}
+
+		e.Groups = append(e.Groups, g)
+	}
+
+	sort.Slice(e.Groups, func(i, j int) bool {
+		return e.Groups[i].Input < e.Groups[j].Input
+	})
+
+	for _, ad := range rm.RoomState.AudioDevices {
+		if !isPowered(ad) {
+			e.Standby = append(e.Standby, ad.Name)
+		}
+	}
+
+	return e, nil
+}
+
+// describe explains why display was chosen for input
+func (r Rule) describe(display, input string) string {
+	switch r {
+	case RuleOnlyDisplay:
+		return fmt.Sprintf("%s is the only display showing %s", display, input)
+	case RulePriorityCache:
+		return fmt.Sprintf("%s already had the audio for %s", display, input)
+	case RuleLowestNumber:
+		return fmt.Sprintf("%s has the lowest display number showing %s", display, input)
+	case RuleConfig:
+		return fmt.Sprintf("the room configuration says %s plays the audio for %s", display, input)
+	case RuleOverride:
+		if display == "" {
+			return fmt.Sprintf("every display showing %s is locked muted", input)
+		}
+		return fmt.Sprintf("%s is locked unmuted", display)
+	default:
+		return string(r)
+	}
+}
+
+// String returns the explanation as text for support techs
+func (e Explanation) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s: power %s, policy %s\n", e.Room, e.Power, e.Policy)
+	if e.MasterMuted {
+		b.WriteString("master muted: every display is muted until the master volume is unmuted\n")
+	}
+
+	for _, g := range e.Groups {
+		winner := g.Winner.Display
+		if winner == "" {
+			winner = "no display"
+		}
+
+		fmt.Fprintf(&b, "%s: %s plays the audio (%s)\n", g.Input, winner, g.Winner.Rule)
+		fmt.Fprintf(&b, "  %s\n", g.Reason)
+		if len(g.Displays) > 1 {
+			fmt.Fprintf(&b, "  displays: %s\n", strings.Join(g.Displays, ", "))
+		}
+		if len(g.Muted) > 0 {
+			fmt.Fprintf(&b, "  muted: %s\n", strings.Join(g.Muted, ", "))
+		}
+	}
+
+	for _, l := range e.Locks {
+		state := "unmuted"
+		if l.Muted {
+			state = "muted"
+		}
+
+		if l.Expires != nil {
+			fmt.Fprintf(&b, "locked: %s %s until %s\n", l.Display, state, l.Expires.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(&b, "locked: %s %s\n", l.Display, state)
+		}
+	}
+
+	if len(e.Standby) > 0 {
+		fmt.Fprintf(&b, "standby: %s\n", strings.Join(e.Standby, ", "))
+	}
+	if len(e.Excluded) > 0 {
+		fmt.Fprintf(&b, "excluded: %s\n", strings.Join(e.Excluded, ", "))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestChooseWinner(t *testing.T) {
+	tests := []struct {
+		name   string
+		choice choice
+		winner Winner
+	}{
+		{
+			name:   "only display",
+			choice: choice{input: "PC1", displays: []string{"D3"}, cached: "D1"},
+			winner: Winner{Display: "D3", Rule: RuleOnlyDisplay},
+		},
+		{
+			name:   "cached",
+			choice: choice{input: "VIA1", displays: []string{"D1", "D2"}, cached: "D2"},
+			winner: Winner{Display: "D2", Rule: RulePriorityCache},
+		},
+		{
+			name:   "cached display not in group",
+			choice: choice{input: "VIA1", displays: []string{"D3", "D2"}, cached: "D1"},
+			winner: Winner{Display: "D2", Rule: RuleLowestNumber},
+		},
+		{
+			name:   "configured",
+			choice: choice{input: "PC1", displays: []string{"D1", "D2", "D3"}, cached: "D2", configured: "D3"},
+			winner: Winner{Display: "D3", Rule: RuleConfig},
+		},
+		{
+			name:   "configured display not in group",
+			choice: choice{input: "PC1", displays: []string{"D1", "D2"}, cached: "D2", configured: "D3"},
+			winner: Winner{Display: "D2", Rule: RulePriorityCache},
+		},
+		{
+			name:   "configured display locked muted",
+			choice: choice{input: "PC1", displays: []string{"D2", "D3"}, configured: "D3", locked: map[string]bool{"D3": true}},
+			winner: Winner{Display: "D2", Rule: RuleLowestNumber},
+		},
+		{
+			name:   "locked unmuted beats configured",
+			choice: choice{input: "PC1", displays: []string{"D2", "D3"}, configured: "D3", locked: map[string]bool{"D2": false}},
+			winner: Winner{Display: "D2", Rule: RuleOverride},
+		},
+		{
+			name:   "lowest number policy",
+			choice: choice{input: "VIA1", displays: []string{"D1", "D2"}, cached: "D2", policy: PolicyLowestNumber},
+			winner: Winner{Display: "D1", Rule: RuleLowestNumber},
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.winner, chooseWinner(tt.choice), tt.name)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+	}
+
+	_, err := manager.Explain()
+	assert.Equal(t, ErrNotLoaded, err)
+
+	assert.Nil(t, manager.InitializeRoomState())
+
+	e, err := manager.Explain()
+	assert.Nil(t, err)
+	assert.Equal(t, PowerPartial, e.Power)
+	assert.Equal(t, PolicySticky, e.Policy)
+	assert.Equal(t, []string{"D3"}, e.Standby)
+	assert.Equal(t, 1, len(e.Groups))
+
+	group := e.Groups[0]
+	assert.Equal(t, "VIA1", group.Input)
+	assert.Equal(t, []string{"D1", "D2"}, group.Displays)
+	assert.Equal(t, Winner{Display: "D1", Rule: RulePriorityCache}, group.Winner)
+	assert.Equal(t, []string{"D2"}, group.Muted)
+	assert.Equal(t, "D1 already had the audio for VIA1", group.Reason)
+
+	assert.Contains(t, e.String(), "VIA1: D1 plays the audio (priority-cache)")
+	assert.Contains(t, e.String(), "standby: D3")
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrUnknownDisplay is returned for displays that aren't in the room
+var ErrUnknownDisplay = errors.New("unknown display")
+
+// ErrCantWin is returned when a display can't be made to play an input's audio
+var ErrCantWin = errors.New("display can't play the audio for the input")
+
+// Lock holds a display muted or unmuted no matter how the room is resolved, e.g. to
+// keep the audio off a display with a broken speaker
+type Lock struct {
+	Display string `json:"display"`
+	Muted   bool   `json:"muted"`
+	// Expires is when the lock is cleared, or nil if it lasts until it is cleared by hand
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type lock struct {
+	Lock
+	timer *time.Timer
+}
+
+// LockDisplay locks display muted or unmuted for d, or until it is unlocked if d is 0,
+// and resolves the room with the lock in place
+func (rm *RoomStateManager) LockDisplay(display string, muted bool, d time.Duration) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if err := rm.checkDisplay(display); err != nil {
+		return err
+	}
+
+	rm.unlock(display)
+
+	l := &lock{Lock: Lock{Display: display, Muted: muted}}
+	if d > 0 {
+		expires := time.Now().Add(d)
+		l.Expires = &expires
+
+		rm.startTimer(&l.timer, d, func() {
+			rm.Log.Info("display lock expired", zap.String("display", display))
+			delete(rm.locks, display)
+			rm.requestResolve("display lock expired")
+		})
+	}
+
+	if rm.locks == nil {
+		rm.locks = make(map[string]*lock)
+	}
+	rm.locks[display] = l
+
+	rm.Log.Info("locked display", zap.String("display", display), zap.Bool("muted", muted), zap.Duration("for", d))
+	return rm.requestResolve(fmt.Sprintf("%s locked", display))
+}
+
+// UnlockDisplay clears the lock on display, if it has one, and resolves the room without it
+func (rm *RoomStateManager) UnlockDisplay(display string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if _, ok := rm.locks[display]; !ok {
+		return nil
+	}
+
+	rm.unlock(display)
+	rm.Log.Info("unlocked display", zap.String("display", display))
+	return rm.requestResolve(fmt.Sprintf("%s unlocked", display))
+}
+
+// ClearLocks clears every lock in the room and resolves the room without them
+func (rm *RoomStateManager) ClearLocks() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if len(rm.locks) == 0 {
+		return nil
+	}
+
+	for display := range rm.locks {
+		rm.unlock(display)
+	}
+
+	rm.Log.Info("cleared display locks")
+	return rm.requestResolve("locks cleared")
+}
+
+// Locks returns the room's display locks, ordered by display
+func (rm *RoomStateManager) Locks() []Lock {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.lockList()
+}
+
+func (rm *RoomStateManager) lockList() []Lock {
+	locks := make([]Lock, 0, len(rm.locks))
+	for _, l := range rm.locks {
+		locks = append(locks, l.Lock)
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Display < locks[j].Display
+	})
+
+	return locks
+}
+
+// SetWinner makes display the one that plays the audio for input, as if it had been the
+// last display to play it, and resolves the room. ErrCantWin is returned, and nothing is
+// changed, if display isn't showing input or if a lock, the room configuration or the
+// policy would still give the audio to another display.
+func (rm *RoomStateManager) SetWinner(input, display string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if err := rm.checkDisplay(display); err != nil {
+		return err
+	}
+
+	displays := groupDisplays(rm.RoomState)[input]
+	showing := false
+	for _, name := range displays {
+		showing = showing || name == display
+	}
+	if !showing {
+		return fmt.Errorf("%w: %s isn't showing %s", ErrCantWin, display, input)
+	}
+
+	c := rm.choice(input, displays)
+	c.cached = display
+	if winner := chooseWinner(c); winner.Display != display {
+		return fmt.Errorf("%w: %s", ErrCantWin, winner.Rule.describe(winner.Display, input))
+	}
+
+	rm.Log.Info("setting audio display", zap.String("input", input), zap.String("display", display))
+	rm.AudioPriorityCache[input] = display
+	return rm.requestResolve(fmt.Sprintf("%s chosen for %s", display, input))
+}
+
+func (rm *RoomStateManager) checkDisplay(display string) error {
+	if rm.RoomState == nil {
+		return ErrNotLoaded
+	}
+
+	if rm.findDisplay(display) == nil {
+		return fmt.Errorf("%w: %s is not a display in %s", ErrUnknownDisplay, display, rm.RoomID)
+	}
+
+	return nil
+}
+
+func (rm *RoomStateManager) unlock(display string) {
+	if l, ok := rm.locks[display]; ok {
+		rm.stopTimer(&l.timer)
+		delete(rm.locks, display)
+	}
+}
+
+// lockedMutes returns whether each locked display is locked muted
+func (rm *RoomStateManager) lockedMutes() map[string]bool {
+	locked := make(map[string]bool, len(rm.locks))
+	for display, l := range rm.locks {
+		locked[display] = l.Muted
+	}
+
+	return locked
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/mute-service/roomconfig"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLocks(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+	}
+
+	assert.NotNil(t, manager.LockDisplay("D1", true, 0), "the room isn't loaded yet")
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.NotNil(t, manager.LockDisplay("D9", true, 0))
+
+	// D1 has a broken speaker
+	assert.Nil(t, manager.LockDisplay("D1", true, 0))
+	room := server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+	assert.Equal(t, "D2", manager.AudioPriorityCache["VIA1"])
+
+	// a display locked unmuted plays even if another has the audio
+	assert.Nil(t, manager.LockDisplay("D1", false, 0))
+	room = server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+	assert.Equal(t, "D2", manager.AudioPriorityCache["VIA1"], "an override shouldn't change the cache")
+
+	// with every display locked muted, nothing plays
+	assert.Nil(t, manager.LockDisplay("D1", true, 0))
+	assert.Nil(t, manager.LockDisplay("D2", true, 0))
+	room = server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+
+	e, err := manager.Explain()
+	assert.Nil(t, err)
+	assert.Equal(t, Winner{Rule: RuleOverride}, e.Groups[0].Winner)
+	assert.Equal(t, 2, len(e.Locks))
+
+	assert.Nil(t, manager.UnlockDisplay("D2"))
+	assert.Equal(t, []Lock{{Display: "D1", Muted: true}}, manager.Locks())
+	assert.Equal(t, false, server.Room().AudioDevices[1].Muted)
+
+	assert.Nil(t, manager.ClearLocks())
+	assert.Equal(t, 0, len(manager.Locks()))
+
+	// locks expire, and the room is resolved again without them
+	assert.Nil(t, manager.LockDisplay("D1", true, 50*time.Millisecond))
+	assert.Equal(t, true, server.Room().AudioDevices[0].Muted)
+	assert.NotNil(t, manager.Locks()[0].Expires)
+
+	puts := len(server.Puts())
+	assert.Eventually(t, func() bool {
+		return len(manager.Locks()) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(server.Puts()) > puts
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSetWinner(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	os.WriteFile(path, []byte("rooms: {}\n"), 0644)
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		RoomConfig:         &roomconfig.File{Path: path},
+	}
+
+	assert.True(t, errors.Is(manager.SetWinner("VIA1", "D2"), ErrNotLoaded))
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.True(t, errors.Is(manager.SetWinner("VIA1", "D9"), ErrUnknownDisplay))
+
+	assert.Nil(t, manager.SetWinner("VIA1", "D2"))
+	assert.Equal(t, "D2", manager.AudioPriorityCache["VIA1"])
+
+	room := server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+
+	// D3 is in standby, so it isn't showing VIA1
+	assert.True(t, errors.Is(manager.SetWinner("VIA1", "D3"), ErrCantWin))
+
+	// a display locked muted can't win
+	assert.Nil(t, manager.LockDisplay("D2", true, 0))
+	assert.True(t, errors.Is(manager.SetWinner("VIA1", "D2"), ErrCantWin))
+	assert.Nil(t, manager.ClearLocks())
+
+	// the room configuration wins over a display set by hand
+	os.WriteFile(path, []byte("rooms:\n  ITB-1108A:\n    audioDisplays:\n      VIA: D1\n"), 0644)
+	assert.Nil(t, manager.Resync())
+	puts := len(server.Puts())
+
+	err := manager.SetWinner("VIA1", "D2")
+	assert.True(t, errors.Is(err, ErrCantWin))
+	assert.Contains(t, err.Error(), "room configuration")
+	assert.Equal(t, puts, len(server.Puts()), "nothing should change")
+	assert.Equal(t, false, server.Room().AudioDevices[0].Muted)
+
+	// and the lowest display number always wins with its policy
+	os.WriteFile(path, []byte("rooms: {}\n"), 0644)
+	manager.Policy = PolicyLowestNumber
+	assert.Nil(t, manager.Resync())
+	assert.True(t, errors.Is(manager.SetWinner("VIA1", "D2"), ErrCantWin))
+	assert.Nil(t, manager.SetWinner("VIA1", "D1"))
+}
@@ -1,12 +1,16 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/roomconfig"
 	"go.uber.org/zap"
 )
 
@@ -16,16 +20,94 @@ type RoomStateManager struct {
 	AvApiAddress       string
 	RoomState          *AVState
 	AudioPriorityCache map[string]string
+
+	// MasterMuted is true while the master volume on the display page is muted
+	MasterMuted bool
+
+	// WarmupPeriod is how long to wait after a display powers on before trusting
+	// its input and mute values. Zero resolves immediately.
+	WarmupPeriod time.Duration
+
+	// CooldownPeriod is how long the room stays cooling after every display is
+	// put in standby before the audio priority cache is cleared
+	CooldownPeriod time.Duration
+
+	// Policy is how the audio display is chosen for inputs shown on several displays
+	Policy Policy
+
+	// AdoptUnmuted fills the audio priority cache from the displays that are already
+	// unmuted whenever the room is fetched, so resolving keeps the audio where it is
+	// instead of moving it to the lowest display number
+	AdoptUnmuted bool
+
+	// Recorder, if set, is given a record of every resolution of the room
+	Recorder DecisionRecorder
+
+	// Backend controls the room's devices. Defaults to the av-api at AvApiAddress.
+	Backend Backend
+
+	// RoomConfig, if set, provides the room's configuration, which is looked up
+	// again each time the room is fetched
+	RoomConfig roomconfig.Provider
+
+	mu            sync.Mutex
+	power         PowerState
+	settleTimer   *time.Timer
+	cooldownTimer *time.Timer
+
+	// when the room state was last fetched and when each device/field was last changed by an event
+	loadedAt    time.Time
+	lastApplied map[string]time.Time
+	staleEvents int
+
+	// the event currently being handled, for decision records
+	trigger *events.Event
+
+	// displays locked muted or unmuted through the API, by display name
+	locks map[string]*lock
+
+	// the room's configuration as of the last time the room was fetched
+	config roomconfig.Config
 }
 
 func (rm *RoomStateManager) HandleEvent(event events.Event) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	// the room hasn't been loaded yet; the event will be reflected in the state once it is
+	if rm.RoomState == nil {
+		rm.Log.Debug("room not loaded yet, ignoring event", zap.String("key", event.Key))
+		return
+	}
+
+	if rm.power == "" {
+		rm.power = rm.settledPowerState()
+	}
+
+	if rm.isStale(event) {
+		rm.staleEvents++
+		rm.Log.Info("dropping stale event", zap.String("device", event.TargetDevice.DeviceID), zap.String("key", event.Key), zap.String("value", event.Value), zap.Time("timestamp", event.Timestamp), zap.Int("staleEvents", rm.staleEvents))
+		return
+	}
+
+	rm.trigger = &event
+	defer func() { rm.trigger = nil }()
+
 	if event.Key == "power" {
 		rm.Log.Debug("power event")
-		if event.Value == "standby" && rm.checkPower() {
-			rm.powerOff()
-		} else if event.Value == "on" && !rm.checkPower() {
-			rm.powerOn()
+		disp, same := rm.comparePower(event.TargetDevice.DeviceID, event.Value)
+		if same {
+			return
 		}
+
+		rm.Log.Debug(fmt.Sprintf("%s : %s", event.TargetDevice.DeviceID, event.Value))
+		if event.Value == "standby" {
+			rm.powerOff(disp)
+		} else {
+			rm.powerOn(disp)
+		}
+
+		rm.updatePowerState(event.Value != "standby")
 	} else if rm.checkPower() {
 		switch event.Key {
 		case "muted":
@@ -39,7 +121,13 @@ func (rm *RoomStateManager) HandleEvent(event events.Event) {
 				rm.Log.Debug(fmt.Sprintf("%s : %v", event.TargetDevice.DeviceID, mutedStatus))
 				disp.Muted = mutedStatus
 
-				rm.ResolveRoom()
+				// unmuting a single display ends the master mute
+				if !mutedStatus && rm.MasterMuted {
+					rm.Log.Debug("display unmuted while master muted, clearing master mute")
+					rm.MasterMuted = false
+				}
+
+				rm.requestResolve("display mute changed")
 			}
 		case "input":
 			rm.Log.Debug("input event")
@@ -47,42 +135,20 @@ func (rm *RoomStateManager) HandleEvent(event events.Event) {
 				rm.Log.Debug(fmt.Sprintf("%s : %s", event.TargetDevice.DeviceID, event.Value))
 				disp.Input = event.Value
 
-				rm.ResolveRoom()
+				rm.requestResolve("display input changed")
 			}
 		case "user-interaction":
 			rm.Log.Debug("master mute pressed")
 			if event.Value == "master volume mute on display page" {
-				for i := range rm.RoomState.AudioDevices {
-					rm.RoomState.AudioDevices[i].Muted = true
-				}
-
-				rm.Log.Debug("parsing room id")
-				bldg, room, err := parseRoomID(rm.RoomID)
-				if err != nil {
-					rm.Log.Error("failed to parse room id", zap.Error(err))
-					return
-				}
-
-				rm.Log.Debug("sending updated room state to av-api")
-				if err := updateAVState("http://"+rm.AvApiAddress+"/buildings/"+bldg+"/rooms/"+room, rm.RoomState, rm.Log); err != nil {
-					rm.Log.Error("failed to update room state on av-api")
-					return
-				}
-
-				rm.Log.Debug(fmt.Sprint(rm.RoomState))
+				rm.masterMute()
+			} else if event.Value == "master volume unmute on display page" {
+				rm.masterUnmute()
 			} else if event.Value == "master volume set on display page" {
 				rm.Log.Debug("master volume changed, resolving room muting")
 
-				rm.Log.Debug("parsing room id")
-				bldg, room, err := parseRoomID(rm.RoomID)
-				if err != nil {
-					rm.Log.Error("failed to parse room id", zap.Error(err))
-					return
-				}
-
-				rm.Log.Debug("resending room state to av-api")
-				if err := updateAVState("http://"+rm.AvApiAddress+"/buildings/"+bldg+"/rooms/"+room, rm.RoomState, rm.Log); err != nil {
-					rm.Log.Error("failed to update room state on av-api")
+				rm.Log.Debug("resending room state")
+				if err := rm.backend().UpdateRoomState(rm.RoomID, rm.RoomState.powered()); err != nil {
+					rm.Log.Error("failed to update room state", zap.Error(err))
 					return
 				}
 			}
@@ -90,30 +156,115 @@ func (rm *RoomStateManager) HandleEvent(event events.Event) {
 	}
 }
 
+func (rm *RoomStateManager) masterMute() {
+	rm.Log.Debug("master mute")
+	rm.MasterMuted = true
+	decision := rm.newDecision("master mute")
+
+	for i := range rm.RoomState.AudioDevices {
+		if isPowered(rm.RoomState.AudioDevices[i]) {
+			rm.RoomState.AudioDevices[i].Muted = true
+		}
+	}
+
+	rm.Log.Debug("sending updated room state")
+	err := rm.backend().UpdateRoomState(rm.RoomID, rm.RoomState.powered())
+	rm.recordDecision(decision, err)
+	if err != nil {
+		rm.Log.Error("failed to update room state", zap.Error(err))
+		return
+	}
+
+	rm.Log.Debug(fmt.Sprint(rm.RoomState))
+}
+
+// masterUnmute restores the layout resolveRoom would produce instead of unmuting every display
+func (rm *RoomStateManager) masterUnmute() {
+	rm.Log.Debug("master unmute")
+	rm.MasterMuted = false
+
+	rm.requestResolve("master unmute")
+}
+
+// isStale returns true if the event is older than the last event applied to the same
+// device and field, or older than the room state itself. Events without a timestamp are
+// never stale.
+func (rm *RoomStateManager) isStale(event events.Event) bool {
+	if event.Timestamp.IsZero() {
+		return false
+	}
+
+	key := event.TargetDevice.DeviceID + "/" + event.Key
+	last := rm.loadedAt
+	if t, ok := rm.lastApplied[key]; ok && t.After(last) {
+		last = t
+	}
+
+	if event.Timestamp.Before(last) {
+		return true
+	}
+
+	if rm.lastApplied == nil {
+		rm.lastApplied = make(map[string]time.Time)
+	}
+	rm.lastApplied[key] = event.Timestamp
+
+	return false
+}
+
+// StaleEvents returns how many events have been dropped for being out of date
+func (rm *RoomStateManager) StaleEvents() int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.staleEvents
+}
+
+// requestResolve resolves the room unless it is warming up or powered off, in
+// which case the next power state transition resolves it
+func (rm *RoomStateManager) requestResolve(reason string) error {
+	if rm.power != PowerOn && rm.power != PowerPartial {
+		rm.Log.Debug("deferring resolution", zap.String("power", string(rm.power)))
+		return nil
+	}
+
+	return rm.resolveRoom(reason)
+}
+
+// checkPower returns true if any display in the room is powered on
 func (rm *RoomStateManager) checkPower() bool {
 	for _, disp := range rm.RoomState.AudioDevices {
-		if disp.Power == "standby" {
-			return false
+		if isPowered(disp) {
+			return true
 		}
 	}
-	return true
+	return false
 }
 
-func (rm *RoomStateManager) powerOn() {
-	rm.Log.Debug("power on")
-	for i := range rm.RoomState.AudioDevices {
-		rm.RoomState.AudioDevices[i].Power = "on"
-	}
+func (rm *RoomStateManager) powerOn(disp *AudioDevice) {
+	rm.Log.Debug(fmt.Sprintf("power on %s", disp.Name))
+	disp.Power = "on"
+}
 
-	rm.ResolveRoom()
+func (rm *RoomStateManager) powerOff(disp *AudioDevice) {
+	rm.Log.Debug(fmt.Sprintf("power off %s", disp.Name))
+	disp.Power = "standby"
+	disp.Muted = false
 }
 
-func (rm *RoomStateManager) powerOff() {
-	rm.Log.Debug("power off")
-	for i := range rm.RoomState.AudioDevices {
-		rm.RoomState.AudioDevices[i].Power = "standby"
-		rm.RoomState.AudioDevices[i].Muted = false
+func (rm *RoomStateManager) comparePower(id, power string) (*AudioDevice, bool) {
+	displayID, err := parseDisplayID(id)
+	if err != nil {
+		return nil, true
+	}
+
+	d := rm.findDisplay(displayID)
+	if d == nil {
+		// display is not an audio device
+		return d, true
 	}
+
+	return d, d.Power == power
 }
 
 func (rm *RoomStateManager) compareInput(id, input string) (*AudioDevice, bool) {
@@ -155,55 +306,188 @@ func (rm *RoomStateManager) findDisplay(id string) *AudioDevice {
 	return nil
 }
 
+// InitializeRoomState loads the room and resolves it if any display is on. Only a failure
+// to load the room is returned; a failed resolve is logged and left to the next event.
 func (rm *RoomStateManager) InitializeRoomState() error {
-	rm.Log.Debug("parsing room id")
-	bldg, room, err := parseRoomID(rm.RoomID)
-	if err != nil {
-		rm.Log.Error("failed to parse room id", zap.Error(err))
+	if err := rm.LoadRoomState(); err != nil {
 		return err
 	}
 
-	rm.Log.Debug("fetching room state from av-api")
-	currentState, err := requestAVState("http://"+rm.AvApiAddress+"/buildings/"+bldg+"/rooms/"+room, rm.Log)
+	if err := rm.ResolveStartup(); err != nil {
+		rm.Log.Warn("failed to resolve room on startup", zap.Error(err))
+	}
+	return nil
+}
+
+// LoadRoomState fetches the room from the backend and works out its power state from
+// scratch, forgetting any warm-up or cool-down in progress
+func (rm *RoomStateManager) LoadRoomState() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if err := rm.loadRoomState(); err != nil {
+		return err
+	}
+
+	if rm.AdoptUnmuted {
+		rm.adoptUnmuted()
+	}
+
+	rm.stopTimer(&rm.settleTimer)
+	rm.stopTimer(&rm.cooldownTimer)
+	rm.power = rm.settledPowerState()
+	rm.Log.Info("room power state", zap.String("power", string(rm.power)))
+	return nil
+}
+
+// ResolveStartup resolves the room if any display is on, since the room may already be
+// showing duplicates, which would otherwise stay until the next event
+func (rm *RoomStateManager) ResolveStartup() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.requestResolve("startup")
+}
+
+func (rm *RoomStateManager) loadRoomState() error {
+	rm.Log.Debug("fetching room state")
+	requestedAt := time.Now()
+	currentState, err := rm.backend().RoomState(rm.RoomID)
 	if err != nil {
-		rm.Log.Error("failed to request room state from the av-api", zap.Error(err))
+		rm.Log.Error("failed to request room state", zap.Error(err))
 		return err
 	}
 
+	rm.loadConfig()
+
+	// excluded displays are left out entirely, so they are never grouped, muted, or counted towards the room's power
+	currentState.without(rm.config.Excluded)
+
 	rm.RoomState = currentState
+	rm.loadedAt = requestedAt
 	rm.Log.Debug(fmt.Sprint(rm.RoomState))
+	return nil
+}
+
+// loadConfig refreshes the room's configuration, keeping the last one if it can't be read
+func (rm *RoomStateManager) loadConfig() {
+	if rm.RoomConfig == nil {
+		return
+	}
+
+	config, err := rm.RoomConfig.RoomConfig(rm.RoomID)
+	switch {
+	case errors.Is(err, roomconfig.ErrNotFound):
+		rm.config = roomconfig.Config{}
+	case err != nil:
+		rm.Log.Warn("failed to refresh room configuration, using the last one", zap.Error(err))
+	default:
+		rm.config = config
+	}
+}
+
+// adoptUnmuted points the audio priority cache at the display already playing each
+// input's audio, keeping the cached display if it is still unmuted. It is only used when
+// the room is first loaded or resynced, never after a warm-up, since displays that are
+// powering on can report mute states that aren't true.
+func (rm *RoomStateManager) adoptUnmuted() {
+	for input, group := range groupDisplays(rm.RoomState) {
+		var unmuted []string
+		for _, name := range group {
+			if d := rm.findDisplay(name); d != nil && !d.Muted {
+				unmuted = append(unmuted, name)
+			}
+		}
+
+		if len(unmuted) == 0 {
+			continue
+		}
+
+		cached := rm.AudioPriorityCache[input]
+		for _, name := range unmuted {
+			if name == cached {
+				unmuted = nil
+				break
+			}
+		}
+
+		if len(unmuted) > 0 {
+			winner := unmuted[lowestNumbered(unmuted)]
+			rm.Log.Debug("adopting unmuted display", zap.String("input", input), zap.String("display", winner))
+			rm.AudioPriorityCache[input] = winner
+		}
+	}
+}
+
+// Resync refetches the room from the av-api and resolves it, for when events may have been missed
+func (rm *RoomStateManager) Resync() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.power == PowerWarming {
+		rm.Log.Debug("displays are warming up, the room will be refetched once they are done")
+		return nil
+	}
+
+	if err := rm.loadRoomState(); err != nil {
+		return err
+	}
+
+	if rm.AdoptUnmuted {
+		rm.adoptUnmuted()
+	}
+
+	next := rm.settledPowerState()
+	switch {
+	case next == PowerOff:
+		rm.coolDown()
+	case next != rm.power:
+		rm.setPowerState(next)
+	default:
+		rm.resolveRoom("resync")
+	}
 
 	return nil
 }
 
 func (rm *RoomStateManager) ResolveRoom() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.resolveRoom("requested")
+}
+
+func (rm *RoomStateManager) resolveRoom(reason string) error {
 	rm.Log.Debug(fmt.Sprint(rm.RoomState))
+	decision := rm.newDecision(reason)
+
 	rm.Log.Debug("grouping displays with similar inputs")
 	displayGroups := groupDisplays(rm.RoomState)
 	rm.Log.Debug(fmt.Sprintf("Display groups: %v", displayGroups))
+	decision.Groups = displayGroups
+	decision.Winners = make(map[string]Winner)
 
 	rm.Log.Debug("muting duplicates across all display groups")
 	for input, group := range displayGroups {
-		if len(group) >= 2 {
-			rm.muteDuplicateDisplays(input, group, rm.RoomState)
-		} else if len(group) == 1 {
-			rm.AudioPriorityCache[input] = group[0]
-			d := rm.findDisplay(group[0])
-			d.Muted = false
+		decision.Winners[input] = rm.muteDuplicateDisplays(input, group, rm.RoomState)
+	}
+
+	// the layout is still resolved so the priority cache stays current, but nothing plays while master muted
+	if rm.MasterMuted {
+		rm.Log.Debug("room is master muted, muting all displays")
+		for i := range rm.RoomState.AudioDevices {
+			if isPowered(rm.RoomState.AudioDevices[i]) {
+				rm.RoomState.AudioDevices[i].Muted = true
+			}
 		}
 	}
 	rm.Log.Debug(fmt.Sprint(rm.RoomState))
 
-	rm.Log.Debug("parsing room id")
-	bldg, room, err := parseRoomID(rm.RoomID)
+	rm.Log.Debug("sending updated room state")
+	err := rm.backend().UpdateRoomState(rm.RoomID, rm.RoomState.powered())
+	rm.recordDecision(decision, err)
 	if err != nil {
-		rm.Log.Error("failed to parse room id", zap.Error(err))
-		return err
-	}
-
-	rm.Log.Debug("sending updated room state to av-api")
-	if err := updateAVState("http://"+rm.AvApiAddress+"/buildings/"+bldg+"/rooms/"+room, rm.RoomState, rm.Log); err != nil {
-		rm.Log.Error("failed to update room state on av-api")
+		rm.Log.Error("failed to update room state", zap.Error(err))
 		return err
 	}
 	return nil
@@ -213,7 +497,7 @@ func groupDisplays(state *AVState) map[string][]string {
 	inputGroups := make(map[string][]string)
 	for _, disp := range state.Displays {
 		for _, audioDev := range state.AudioDevices {
-			if disp.Name == audioDev.Name {
+			if disp.Name == audioDev.Name && isPowered(audioDev) {
 				if _, ok := inputGroups[audioDev.Input]; !ok {
 					inputGroups[audioDev.Input] = []string{disp.Name}
 				} else {
@@ -225,38 +509,122 @@ func groupDisplays(state *AVState) map[string][]string {
 	return inputGroups
 }
 
-func (rm *RoomStateManager) muteDuplicateDisplays(input string, displays []string, state *AVState) {
-	chosenDisplay := -1
+// isPowered returns false only for displays known to be in standby
+func isPowered(ad AudioDevice) bool {
+	return ad.Power != "standby"
+}
 
-	if _, ok := rm.AudioPriorityCache[input]; ok {
-		for i, disp := range displays {
-			if disp == rm.AudioPriorityCache[input] {
-				chosenDisplay = i
-			}
+func (rm *RoomStateManager) muteDuplicateDisplays(input string, displays []string, state *AVState) Winner {
+	winner := chooseWinner(rm.choice(input, displays))
+
+	// a lock says nothing about which display should have the audio once it is cleared
+	if winner.Rule != RuleOverride {
+		rm.AudioPriorityCache[input] = winner.Display
+	}
+
+	for i := range state.AudioDevices {
+		ad := &state.AudioDevices[i]
+		switch {
+		case ad.Name == winner.Display:
+			ad.Muted = false
+		case ad.Input == input && isPowered(*ad):
+			ad.Muted = true
+		default:
+			continue
+		}
+
+		if l, ok := rm.locks[ad.Name]; ok {
+			ad.Muted = l.Muted
+		}
+	}
+
+	return winner
+}
+
+// choice is everything that decides which display plays the audio for an input
+type choice struct {
+	input    string
+	displays []string
+	// cached is the display that last played the input's audio
+	cached string
+	policy Policy
+	// locked is whether each locked display is locked muted
+	locked map[string]bool
+	// configured is the display the room configuration says plays the input's audio, if any
+	configured string
+}
+
+// choice collects what the manager knows about an input's displays
+func (rm *RoomStateManager) choice(input string, displays []string) choice {
+	configured, _ := rm.config.AudioDisplay(input)
+
+	return choice{
+		input:      input,
+		displays:   displays,
+		cached:     rm.AudioPriorityCache[input],
+		policy:     rm.Policy,
+		locked:     rm.lockedMutes(),
+		configured: configured,
+	}
+}
+
+// chooseWinner picks the display to play the audio for an input. It has no side
+// effects, so it can explain a room's layout as well as resolve it.
+//
+// A display locked unmuted always wins, and displays locked muted never do. If every
+// display is locked muted, the winner has no display. Otherwise the display from the
+// room configuration wins if it is showing the input, and then the policy decides.
+func chooseWinner(c choice) Winner {
+	var unmuted, unlocked []string
+	for _, disp := range c.displays {
+		muted, locked := c.locked[disp]
+		switch {
+		case !locked:
+			unlocked = append(unlocked, disp)
+		case !muted:
+			unmuted = append(unmuted, disp)
+		}
+	}
+
+	switch {
+	case len(unmuted) > 0:
+		return Winner{Display: unmuted[lowestNumbered(unmuted)], Rule: RuleOverride}
+	case len(unlocked) == 0:
+		return Winner{Rule: RuleOverride}
+	case len(c.displays) == 1:
+		return Winner{Display: c.displays[0], Rule: RuleOnlyDisplay}
+	}
+
+	for _, disp := range unlocked {
+		if disp == c.configured {
+			return Winner{Display: disp, Rule: RuleConfig}
 		}
 	}
 
-	if chosenDisplay == -1 {
-		lowestDisplayNum := 100
-		chosenDisplay = 0
-		for i, disp := range displays {
-			num, err := parseDisplayNumber(disp)
-			if err == nil && num < lowestDisplayNum {
-				lowestDisplayNum = num
-				chosenDisplay = i
+	if c.policy != PolicyLowestNumber {
+		for _, disp := range unlocked {
+			if disp == c.cached {
+				return Winner{Display: disp, Rule: RulePriorityCache}
 			}
 		}
 	}
 
-	rm.AudioPriorityCache[input] = displays[chosenDisplay]
+	return Winner{Display: unlocked[lowestNumbered(unlocked)], Rule: RuleLowestNumber}
+}
 
-	for i := range state.AudioDevices {
-		if state.AudioDevices[i].Name == displays[chosenDisplay] {
-			state.AudioDevices[i].Muted = false
-		} else if state.AudioDevices[i].Input == input {
-			state.AudioDevices[i].Muted = true
+// lowestNumbered returns the index of the display with the lowest display number,
+// or 0 if none of them are numbered
+func lowestNumbered(displays []string) int {
+	lowestDisplayNum := 100
+	chosenDisplay := 0
+	for i, disp := range displays {
+		num, err := parseDisplayNumber(disp)
+		if err == nil && num < lowestDisplayNum {
+			lowestDisplayNum = num
+			chosenDisplay = i
 		}
 	}
+	return chosenDisplay
 }
 
 func parseDisplayNumber(displayName string) (int, error) {
@@ -1,12 +1,36 @@
 package state
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/roomconfig"
+	"github.com/byuoitav/mute-service/state/avapitest"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
 
+// lastPut decodes the last PUT made to the fake av-api
+func lastPut(t *testing.T, server *avapitest.Server) AVState {
+	puts := server.Puts()
+	if len(puts) == 0 {
+		t.Fatal("no PUTs made to the av-api")
+	}
+
+	var state AVState
+	if err := json.Unmarshal(puts[len(puts)-1].Body, &state); err != nil {
+		t.Fatalf("invalid PUT body: %s", err)
+	}
+	return state
+}
+
 func TestPowerOn(t *testing.T) {
 	manager := &RoomStateManager{
 		Log:                zap.NewExample(),
@@ -20,7 +44,7 @@ func TestPowerOn(t *testing.T) {
 						Name:  "D1",
 						Muted: false,
 					},
-					Power: "on",
+					Power: "standby",
 					Input: "VIA1",
 				},
 				{
@@ -28,7 +52,7 @@ func TestPowerOn(t *testing.T) {
 						Name:  "D2",
 						Muted: false,
 					},
-					Power: "on",
+					Power: "standby",
 					Input: "VIA1",
 				},
 				{
@@ -36,16 +60,21 @@ func TestPowerOn(t *testing.T) {
 						Name:  "D3",
 						Muted: false,
 					},
-					Power: "on",
+					Power: "standby",
 					Input: "VIA1",
 				},
 			},
 		},
 	}
 
-	manager.powerOn()
+	assert.Equal(t, false, manager.checkPower())
+
+	manager.powerOn(&manager.RoomState.AudioDevices[1])
 
 	assert.Equal(t, true, manager.checkPower())
+	assert.Equal(t, "standby", manager.RoomState.AudioDevices[0].Power)
+	assert.Equal(t, "on", manager.RoomState.AudioDevices[1].Power)
+	assert.Equal(t, "standby", manager.RoomState.AudioDevices[2].Power)
 }
 
 func TestPowerOff(t *testing.T) {
@@ -67,7 +96,7 @@ func TestPowerOff(t *testing.T) {
 				{
 					AudioBase: AudioBase{
 						Name:  "D2",
-						Muted: false,
+						Muted: true,
 					},
 					Power: "on",
 					Input: "VIA1",
@@ -84,11 +113,83 @@ func TestPowerOff(t *testing.T) {
 		},
 	}
 
-	manager.powerOff()
+	manager.powerOff(&manager.RoomState.AudioDevices[1])
+	assert.Equal(t, true, manager.checkPower())
+	assert.Equal(t, false, manager.RoomState.AudioDevices[1].Muted)
 
+	manager.powerOff(&manager.RoomState.AudioDevices[0])
+	manager.powerOff(&manager.RoomState.AudioDevices[2])
 	assert.Equal(t, false, manager.checkPower())
 }
 
+func TestPartialPower(t *testing.T) {
+	server := avapitest.NewServer(avapitest.Room{})
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+				{
+					Name: "D3",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: false,
+					},
+					Power: "standby",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "PC1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D3",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+			},
+		},
+	}
+
+	// D1 is intentionally off, so D3 moving to PC1 must still be resolved
+	manager.HandleEvent(events.Event{Key: "input", Value: "PC1", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D3"}})
+	assert.Equal(t, false, manager.RoomState.AudioDevices[1].Muted)
+	assert.Equal(t, true, manager.RoomState.AudioDevices[2].Muted)
+	assert.Equal(t, 2, len(lastPut(t, server).AudioDevices))
+
+	// powering D1 on puts it alone on VIA1
+	manager.HandleEvent(events.Event{Key: "power", Value: "on", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D1"}})
+	assert.Equal(t, "on", manager.RoomState.AudioDevices[0].Power)
+	assert.Equal(t, false, manager.RoomState.AudioDevices[0].Muted)
+	assert.Equal(t, 3, len(lastPut(t, server).AudioDevices))
+
+	// turning D2 off leaves D3 as the only display on PC1
+	manager.HandleEvent(events.Event{Key: "power", Value: "standby", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D2"}})
+	assert.Equal(t, false, manager.RoomState.AudioDevices[2].Muted)
+	assert.Equal(t, 2, len(lastPut(t, server).AudioDevices))
+}
+
 func TestCompareInput(t *testing.T) {
 	manager := &RoomStateManager{
 		Log:                nil,
@@ -479,3 +580,653 @@ func TestParseRoomID(t *testing.T) {
 	_, _, err = parseRoomID("BadID")
 	assert.NotNil(t, err)
 }
+
+func TestMasterUnmute(t *testing.T) {
+	server := avapitest.NewServer(avapitest.Room{})
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: map[string]string{"VIA1": "D2"},
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+				{
+					Name: "D3",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: true,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D3",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "PC1",
+				},
+			},
+		},
+	}
+
+	manager.HandleEvent(events.Event{Key: "user-interaction", Value: "master volume mute on display page"})
+	assert.Equal(t, true, manager.MasterMuted)
+	for _, ad := range lastPut(t, server).AudioDevices {
+		assert.Equal(t, true, ad.Muted, ad.Name)
+	}
+
+	// input changes while master muted must not unmute anything
+	manager.HandleEvent(events.Event{Key: "input", Value: "VIA1", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D3"}})
+	assert.Equal(t, true, manager.MasterMuted)
+	for _, ad := range lastPut(t, server).AudioDevices {
+		assert.Equal(t, true, ad.Muted, ad.Name)
+	}
+
+	// unmuting restores the resolved layout: D2 keeps the audio for VIA1
+	manager.HandleEvent(events.Event{Key: "user-interaction", Value: "master volume unmute on display page"})
+	assert.Equal(t, false, manager.MasterMuted)
+	assert.Equal(t, true, manager.RoomState.AudioDevices[0].Muted)
+	assert.Equal(t, false, manager.RoomState.AudioDevices[1].Muted)
+	assert.Equal(t, true, manager.RoomState.AudioDevices[2].Muted)
+	assert.Equal(t, false, lastPut(t, server).AudioDevices[1].Muted)
+}
+
+func TestWarmup(t *testing.T) {
+	// the displays forgot their mute state while powering on
+	server := avapitest.NewServer(avapitest.Room{
+		Displays: []avapitest.Display{
+			{
+				Name: "D1",
+			},
+			{
+				Name: "D2",
+			},
+		},
+		AudioDevices: []avapitest.AudioDevice{
+			{
+				Name:  "D1",
+				Muted: false,
+				Power: "on",
+				Input: "VIA1",
+			},
+			{
+				Name:  "D2",
+				Muted: false,
+				Power: "on",
+				Input: "VIA1",
+			},
+		},
+	})
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: map[string]string{"VIA1": "D1"},
+		WarmupPeriod:       50 * time.Millisecond,
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: false,
+					},
+					Power: "standby",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "standby",
+					Input: "VIA1",
+				},
+			},
+		},
+	}
+
+	manager.HandleEvent(events.Event{Key: "power", Value: "on", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D1"}})
+	manager.HandleEvent(events.Event{Key: "power", Value: "on", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D2"}})
+	manager.HandleEvent(events.Event{Key: "input", Value: "PC1", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D2"}})
+
+	assert.Equal(t, 0, len(server.Requests()))
+
+	// once warmed up, the room is refetched and resolved exactly once
+	assert.Eventually(t, func() bool {
+		return len(server.Puts()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	requests := server.Requests()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, http.MethodGet, requests[0].Method)
+	assert.Equal(t, false, lastPut(t, server).AudioDevices[0].Muted)
+	assert.Equal(t, true, lastPut(t, server).AudioDevices[1].Muted)
+}
+
+func TestStaleEvents(t *testing.T) {
+	server := avapitest.NewServer(avapitest.Room{})
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA2",
+				},
+			},
+		},
+	}
+
+	now := time.Now()
+	input := func(display, value string, timestamp time.Time) {
+		manager.HandleEvent(events.Event{Key: "input", Value: value, Timestamp: timestamp, TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-" + display}})
+	}
+
+	input("D1", "PC1", now)
+	input("D1", "VIA1", now.Add(-time.Second))
+	assert.Equal(t, "PC1", manager.RoomState.AudioDevices[0].Input)
+	assert.Equal(t, 1, manager.StaleEvents())
+
+	// other devices and fields are tracked separately
+	input("D2", "PC1", now.Add(-time.Second))
+	assert.Equal(t, "PC1", manager.RoomState.AudioDevices[1].Input)
+
+	// events without a timestamp are always applied
+	input("D1", "VIA1", time.Time{})
+	assert.Equal(t, "VIA1", manager.RoomState.AudioDevices[0].Input)
+	assert.Equal(t, 1, manager.StaleEvents())
+
+	// events from before the room state was fetched are stale
+	manager.loadedAt = now.Add(time.Minute)
+	input("D2", "VIA2", now)
+	assert.Equal(t, "PC1", manager.RoomState.AudioDevices[1].Input)
+	assert.Equal(t, 2, manager.StaleEvents())
+}
+
+type decisions []Decision
+
+func (d *decisions) RecordDecision(decision Decision) {
+	*d = append(*d, decision)
+}
+
+func TestDecisionRecord(t *testing.T) {
+	server := avapitest.NewServer(avapitest.Room{})
+	defer server.Close()
+	server.SetStatus(http.StatusInternalServerError)
+
+	recorded := &decisions{}
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: map[string]string{"VIA1": "D2"},
+		Recorder:           recorded,
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+				{
+					Name: "D3",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D3",
+						Muted: false,
+					},
+					Power: "on",
+					Input: "VIA1",
+				},
+			},
+		},
+	}
+
+	event := events.Event{Key: "input", Value: "PC1", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D3"}}
+	manager.HandleEvent(event)
+
+	assert.Equal(t, 1, len(*recorded))
+	d := (*recorded)[0]
+	assert.Equal(t, "ITB-1108A", d.Room)
+	assert.Equal(t, &event, d.Trigger)
+	assert.Equal(t, PolicySticky, d.Policy)
+	assert.Equal(t, false, d.Before[0].Muted)
+	assert.Equal(t, true, d.After[0].Muted)
+	assert.Equal(t, []string{"D1", "D2"}, d.Groups["VIA1"])
+	assert.Equal(t, Winner{Display: "D2", Rule: RulePriorityCache}, d.Winners["VIA1"])
+	assert.Equal(t, Winner{Display: "D3", Rule: RuleOnlyDisplay}, d.Winners["PC1"])
+	assert.Equal(t, false, d.Applied)
+	assert.NotEmpty(t, d.Error)
+}
+
+func testRoom() avapitest.Room {
+	return avapitest.Room{
+		Displays: []avapitest.Display{
+			{
+				Name: "D1",
+			},
+			{
+				Name: "D2",
+			},
+			{
+				Name: "D3",
+			},
+		},
+		AudioDevices: []avapitest.AudioDevice{
+			{
+				Name:  "D1",
+				Muted: false,
+				Power: "on",
+				Input: "VIA1",
+			},
+			{
+				Name:  "D2",
+				Muted: false,
+				Power: "on",
+				Input: "VIA1",
+			},
+			{
+				Name:  "D3",
+				Muted: false,
+				Power: "standby",
+				Input: "PC1",
+			},
+			{
+				Name:  "MIC1",
+				Muted: false,
+				Power: "on",
+			},
+		},
+	}
+}
+
+func TestInitializeRoomState(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Equal(t, 3, len(manager.RoomState.AudioDevices), "non-display audio devices should be trimmed")
+	assert.Equal(t, PowerPartial, manager.PowerState())
+	assert.Equal(t, "/buildings/ITB/rooms/1108A", server.Requests()[0].Path)
+	assert.Equal(t, true, server.Room().AudioDevices[1].Muted, "the room should be resolved once it is loaded")
+
+	server.SetStatus(http.StatusBadGateway)
+	assert.NotNil(t, manager.InitializeRoomState())
+
+	server.SetStatus(0)
+	server.SetDropConnections(true)
+	assert.NotNil(t, manager.InitializeRoomState())
+	assert.Equal(t, 3, len(manager.RoomState.AudioDevices), "a failed fetch should keep the last known state")
+}
+
+// failingUpdates is a Backend whose reads work but whose updates always fail
+type failingUpdates struct {
+	Backend
+}
+
+func (f failingUpdates) UpdateRoomState(roomID string, state *AVState) error {
+	return errors.New("av-api unavailable")
+}
+
+func TestLoadRoomState(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AudioPriorityCache: make(map[string]string),
+		WarmupPeriod:       time.Hour,
+		Backend:            failingUpdates{&AVAPI{Address: server.Address(), Log: zap.NewExample()}},
+	}
+
+	// a failed startup resolve doesn't fail loading the room
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Equal(t, PowerPartial, manager.PowerState())
+	assert.NotNil(t, manager.ResolveStartup())
+
+	// loading again forgets the warm-up in progress
+	manager.HandleEvent(events.Event{Key: "power", Value: "on", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D3"}})
+	assert.Equal(t, PowerWarming, manager.PowerState())
+
+	assert.Nil(t, manager.LoadRoomState())
+	assert.Equal(t, PowerPartial, manager.PowerState())
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	assert.Nil(t, manager.settleTimer)
+}
+
+func TestResolveRoom(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+
+	server.SetLatency(20 * time.Millisecond)
+	assert.Nil(t, manager.ResolveRoom())
+
+	room := server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+	assert.Equal(t, false, room.AudioDevices[2].Muted, "displays in standby should not be touched")
+
+	put := lastPut(t, server)
+	assert.Equal(t, 2, len(put.AudioDevices))
+	assert.Equal(t, "/buildings/ITB/rooms/1108A", server.Puts()[0].Path)
+
+	server.SetStatus(http.StatusInternalServerError)
+	assert.NotNil(t, manager.ResolveRoom())
+}
+
+func TestResync(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+
+	// D3 was turned on and switched to VIA1 while events were being missed
+	room := testRoom()
+	room.AudioDevices[2].Power = "on"
+	room.AudioDevices[2].Input = "VIA1"
+	server.SetRoom(room)
+
+	assert.Nil(t, manager.Resync())
+	assert.Equal(t, PowerOn, manager.PowerState())
+
+	room = server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+	assert.Equal(t, true, room.AudioDevices[2].Muted)
+}
+
+func TestAdoptUnmuted(t *testing.T) {
+	// D2 is already playing VIA1's audio when the service starts
+	room := testRoom()
+	room.AudioDevices[0].Muted = true
+	server := avapitest.NewServer(room)
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		AdoptUnmuted:       true,
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Equal(t, "D2", manager.AudioPriorityCache["VIA1"])
+
+	room = server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+
+	// someone switched the audio to D1 by hand while events were being missed
+	room.AudioDevices[0].Muted = false
+	room.AudioDevices[1].Muted = true
+	server.SetRoom(room)
+
+	assert.Nil(t, manager.Resync())
+	assert.Equal(t, "D1", manager.AudioPriorityCache["VIA1"])
+
+	room = server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+
+	// without it, startup moves the audio to the lowest display number
+	room.AudioDevices[0].Muted = true
+	room.AudioDevices[1].Muted = false
+	server.SetRoom(room)
+
+	manager.AdoptUnmuted = false
+	manager.AudioPriorityCache = make(map[string]string)
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Equal(t, "D1", manager.AudioPriorityCache["VIA1"])
+}
+
+func TestAdoptUnmutedWarmup(t *testing.T) {
+	// D1 has VIA1's audio and D2 is off
+	room := testRoom()
+	room.AudioDevices[1].Power = "standby"
+	room.AudioDevices[1].Muted = true
+	server := avapitest.NewServer(room)
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		AdoptUnmuted:       true,
+		WarmupPeriod:       20 * time.Millisecond,
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Equal(t, "D1", manager.AudioPriorityCache["VIA1"])
+
+	// D2 powers on, and while it warms up the av-api reports D2 unmuted and D1 muted
+	room = server.Room()
+	room.AudioDevices[0].Muted = true
+	room.AudioDevices[1].Power = "on"
+	room.AudioDevices[1].Muted = false
+	server.SetRoom(room)
+
+	manager.HandleEvent(events.Event{Key: "power", Value: "on", TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D2"}})
+
+	// the refetch after warm-up doesn't adopt the wrong unmute, so D1 keeps the audio
+	assert.Eventually(t, func() bool {
+		room := server.Room()
+		return !room.AudioDevices[0].Muted && room.AudioDevices[1].Muted
+	}, time.Second, 10*time.Millisecond)
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	assert.Equal(t, "D1", manager.AudioPriorityCache["VIA1"])
+}
+
+func TestPolicyLowestNumber(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		Policy:             PolicyLowestNumber,
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+
+	// the cache is ignored, so D1 keeps the audio
+	manager.AudioPriorityCache["VIA1"] = "D2"
+	assert.Nil(t, manager.ResolveRoom())
+
+	room := server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, true, room.AudioDevices[1].Muted)
+
+	assert.Equal(t, true, PolicyLowestNumber.Valid())
+	assert.Equal(t, true, Policy("").Valid())
+	assert.Equal(t, false, Policy("loudest").Valid())
+}
+
+func TestExcludedDisplays(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	// D1 is a confidence monitor
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	os.WriteFile(path, []byte("rooms:\n  ITB-1108A:\n    autoMute: true\n    excluded: [D1]\n"), 0644)
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		RoomConfig:         &roomconfig.File{Path: path},
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+	assert.Nil(t, manager.findDisplay("D1"))
+	assert.Equal(t, map[string][]string{"VIA1": {"D2"}}, groupDisplays(manager.RoomState))
+
+	room := server.Room()
+	assert.Equal(t, false, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted, "D2 should be alone on VIA1")
+
+	put := lastPut(t, server)
+	assert.Equal(t, 1, len(put.AudioDevices))
+	assert.Equal(t, "D2", put.AudioDevices[0].Name)
+
+	// events for excluded displays are ignored
+	manager.HandleEvent(events.Event{
+		TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-D1"},
+		Key:          "muted",
+		Value:        "true",
+	})
+	assert.Nil(t, manager.findDisplay("D1"))
+
+	e, err := manager.Explain()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"D1"}, e.Excluded)
+
+	// the configuration is reread when the room is fetched again
+	os.WriteFile(path, []byte("rooms:\n  ITB-1108A:\n    autoMute: true\n"), 0644)
+	assert.Nil(t, manager.Resync())
+	assert.NotNil(t, manager.findDisplay("D1"))
+	assert.Equal(t, true, server.Room().AudioDevices[0].Muted, "D2 already had the audio")
+}
+
+func TestConfiguredAudioDisplay(t *testing.T) {
+	server := avapitest.NewServer(testRoom())
+	defer server.Close()
+
+	// VIA always plays on D2
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	os.WriteFile(path, []byte("rooms:\n  ITB-1108A:\n    autoMute: true\n    audioDisplays:\n      VIA: D2\n"), 0644)
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: make(map[string]string),
+		RoomConfig:         &roomconfig.File{Path: path},
+	}
+
+	assert.Nil(t, manager.InitializeRoomState())
+
+	room := server.Room()
+	assert.Equal(t, true, room.AudioDevices[0].Muted)
+	assert.Equal(t, false, room.AudioDevices[1].Muted)
+
+	// the configuration wins over the display that last had the audio
+	manager.AudioPriorityCache["VIA1"] = "D1"
+	assert.Nil(t, manager.ResolveRoom())
+	assert.Equal(t, false, server.Room().AudioDevices[1].Muted)
+
+	e, err := manager.Explain()
+	assert.Nil(t, err)
+	assert.Equal(t, Winner{Display: "D2", Rule: RuleConfig}, e.Groups[0].Winner)
+}
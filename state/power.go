@@ -0,0 +1,157 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PowerState is the power state of the room as a whole
+type PowerState string
+
+const (
+	// PowerOff means every display is in standby
+	PowerOff PowerState = "off"
+	// PowerWarming means a display recently powered on and its values can't be trusted yet
+	PowerWarming PowerState = "warming"
+	// PowerOn means every display is powered on
+	PowerOn PowerState = "on"
+	// PowerCooling means every display was just put in standby, but the room hasn't been forgotten yet
+	PowerCooling PowerState = "cooling"
+	// PowerPartial means some displays are powered on and some are in standby
+	PowerPartial PowerState = "partial"
+)
+
+// PowerState returns the current power state of the room
+func (rm *RoomStateManager) PowerState() PowerState {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.power
+}
+
+// settledPowerState returns the power state implied by the displays' power alone
+func (rm *RoomStateManager) settledPowerState() PowerState {
+	on := 0
+	for _, ad := range rm.RoomState.AudioDevices {
+		if isPowered(ad) {
+			on++
+		}
+	}
+
+	switch {
+	case on == 0:
+		return PowerOff
+	case on == len(rm.RoomState.AudioDevices):
+		return PowerOn
+	default:
+		return PowerPartial
+	}
+}
+
+// updatePowerState moves the room to the next power state after a display changes power
+func (rm *RoomStateManager) updatePowerState(poweredOn bool) {
+	settled := rm.settledPowerState()
+
+	switch {
+	case settled == PowerOff:
+		rm.coolDown()
+	case poweredOn && rm.WarmupPeriod > 0:
+		// restarts the warm-up if the room was already warming
+		rm.setPowerState(PowerWarming)
+	case rm.power == PowerWarming:
+		// a display turned off while the others are still warming up
+	default:
+		rm.setPowerState(settled)
+	}
+}
+
+func (rm *RoomStateManager) coolDown() {
+	switch {
+	case rm.power == PowerOff || rm.power == PowerCooling:
+	case rm.CooldownPeriod > 0:
+		rm.setPowerState(PowerCooling)
+	default:
+		rm.setPowerState(PowerOff)
+	}
+}
+
+// setPowerState transitions the room to next, starting or stopping the settle timers
+// and resolving the room as needed
+func (rm *RoomStateManager) setPowerState(next PowerState) {
+	prev := rm.power
+	rm.power = next
+
+	if prev != next {
+		rm.Log.Info("room power state changed", zap.String("from", string(prev)), zap.String("to", string(next)))
+	}
+
+	if next != PowerWarming {
+		rm.stopTimer(&rm.settleTimer)
+	}
+	if next != PowerCooling {
+		rm.stopTimer(&rm.cooldownTimer)
+	}
+
+	switch next {
+	case PowerWarming:
+		rm.Log.Debug("waiting for displays to warm up", zap.Duration("warmup", rm.WarmupPeriod))
+		rm.startTimer(&rm.settleTimer, rm.WarmupPeriod, rm.settle)
+	case PowerCooling:
+		if prev != PowerCooling {
+			rm.startTimer(&rm.cooldownTimer, rm.CooldownPeriod, func() {
+				rm.setPowerState(PowerOff)
+			})
+		}
+	case PowerOff:
+		// the room is done being used, so its audio preferences are too
+		rm.Log.Debug("clearing audio priority cache")
+		rm.AudioPriorityCache = make(map[string]string)
+		rm.MasterMuted = false
+	case PowerOn, PowerPartial:
+		rm.resolveRoom(fmt.Sprintf("room power %s", next))
+	}
+}
+
+// settle refetches the room once displays have warmed up, since the values they
+// reported while powering on can't be trusted, and then resolves the room once
+func (rm *RoomStateManager) settle() {
+	rm.Log.Debug("displays warmed up, refreshing room state")
+	if err := rm.loadRoomState(); err != nil {
+		rm.Log.Error("failed to refresh room state after warm-up", zap.Error(err))
+	}
+
+	if next := rm.settledPowerState(); next == PowerOff {
+		rm.coolDown()
+	} else {
+		rm.setPowerState(next)
+	}
+}
+
+// startTimer runs f with the manager locked after d, replacing any timer already in slot
+func (rm *RoomStateManager) startTimer(slot **time.Timer, d time.Duration, f func()) {
+	rm.stopTimer(slot)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		rm.mu.Lock()
+		defer rm.mu.Unlock()
+
+		// the timer was replaced or stopped while it was firing
+		if *slot != timer {
+			return
+		}
+
+		*slot = nil
+		f()
+	})
+	*slot = timer
+}
+
+func (rm *RoomStateManager) stopTimer(slot **time.Timer) {
+	if *slot != nil {
+		(*slot).Stop()
+		*slot = nil
+	}
+}
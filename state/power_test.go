@@ -0,0 +1,109 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/byuoitav/common/v2/events"
+	"github.com/byuoitav/mute-service/state/avapitest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestPowerStates(t *testing.T) {
+	server := avapitest.NewServer(avapitest.Room{
+		Displays: []avapitest.Display{
+			{
+				Name: "D1",
+			},
+			{
+				Name: "D2",
+			},
+		},
+		AudioDevices: []avapitest.AudioDevice{
+			{
+				Name:  "D1",
+				Muted: false,
+				Power: "on",
+				Input: "VIA1",
+			},
+			{
+				Name:  "D2",
+				Muted: false,
+				Power: "standby",
+				Input: "VIA1",
+			},
+		},
+	})
+	defer server.Close()
+
+	manager := &RoomStateManager{
+		Log:                zap.NewExample(),
+		RoomID:             "ITB-1108A",
+		AvApiAddress:       server.Address(),
+		AudioPriorityCache: map[string]string{"VIA1": "D2"},
+		WarmupPeriod:       20 * time.Millisecond,
+		CooldownPeriod:     200 * time.Millisecond,
+		RoomState: &AVState{
+			Displays: []Display{
+				{
+					Name: "D1",
+				},
+				{
+					Name: "D2",
+				},
+			},
+			AudioDevices: []AudioDevice{
+				{
+					AudioBase: AudioBase{
+						Name:  "D1",
+						Muted: false,
+					},
+					Power: "standby",
+					Input: "VIA1",
+				},
+				{
+					AudioBase: AudioBase{
+						Name:  "D2",
+						Muted: false,
+					},
+					Power: "standby",
+					Input: "VIA1",
+				},
+			},
+		},
+	}
+
+	power := func(display, value string) {
+		manager.HandleEvent(events.Event{Key: "power", Value: value, TargetDevice: events.BasicDeviceInfo{DeviceID: "ITB-1108A-" + display}})
+	}
+
+	power("D1", "on")
+	assert.Equal(t, PowerWarming, manager.PowerState())
+
+	// the refetched state only has D1 on
+	assert.Eventually(t, func() bool {
+		return manager.PowerState() == PowerPartial
+	}, time.Second, 5*time.Millisecond)
+
+	// turning everything off cools down before forgetting the cache
+	power("D1", "standby")
+	assert.Equal(t, PowerCooling, manager.PowerState())
+	manager.mu.Lock()
+	assert.Equal(t, "D1", manager.AudioPriorityCache["VIA1"])
+	manager.mu.Unlock()
+
+	// powering back on while cooling keeps the cache
+	power("D1", "on")
+	assert.Equal(t, PowerWarming, manager.PowerState())
+	power("D1", "standby")
+	assert.Equal(t, PowerCooling, manager.PowerState())
+
+	assert.Eventually(t, func() bool {
+		return manager.PowerState() == PowerOff
+	}, time.Second, 5*time.Millisecond)
+
+	manager.mu.Lock()
+	assert.Empty(t, manager.AudioPriorityCache)
+	manager.mu.Unlock()
+}
@@ -36,9 +36,53 @@ func (ad AudioDevice) MarshalJSON() ([]byte, error) {
 	return json.Marshal(ad.AudioBase)
 }
 
-func requestAVState(url string, log *zap.Logger) (*AVState, error) {
+// powered returns a copy of the state with only the audio devices that are powered on,
+// so displays in standby are never sent mute commands
+func (s *AVState) powered() *AVState {
+	p := &AVState{
+		Displays: s.Displays,
+	}
+
+	for _, ad := range s.AudioDevices {
+		if isPowered(ad) {
+			p.AudioDevices = append(p.AudioDevices, ad)
+		}
+	}
+
+	return p
+}
+
+// without removes the named displays from the state
+func (s *AVState) without(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	excluded := make(map[string]bool, len(names))
+	for _, name := range names {
+		excluded[name] = true
+	}
+
+	displays := s.Displays[:0]
+	for _, d := range s.Displays {
+		if !excluded[d.Name] {
+			displays = append(displays, d)
+		}
+	}
+	s.Displays = displays
+
+	audioDevices := s.AudioDevices[:0]
+	for _, ad := range s.AudioDevices {
+		if !excluded[ad.Name] {
+			audioDevices = append(audioDevices, ad)
+		}
+	}
+	s.AudioDevices = audioDevices
+}
+
+func requestAVState(client *http.Client, url string, log *zap.Logger) (*AVState, error) {
 	log.Debug("sending request to av-api for room status")
-	resp, err := http.Get(url)
+	resp, err := client.Get(url)
 	if err != nil {
 		log.Error("failed to get room status", zap.Error(err))
 		return nil, err
@@ -76,11 +120,9 @@ func requestAVState(url string, log *zap.Logger) (*AVState, error) {
 	return &roomState, nil
 }
 
-func updateAVState(url string, state *AVState, log *zap.Logger) error {
+func updateAVState(client *http.Client, url string, state *AVState, log *zap.Logger) error {
 	body, _ := json.Marshal(state)
 
-	client := &http.Client{}
-
 	log.Debug("sending request to av-api to update room state")
 	request, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(body))
 	if err != nil {